@@ -0,0 +1,133 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// acceptRange is a single media range of an Accept header with its quality
+type acceptRange struct {
+	Type    string
+	Subtype string
+	Quality float64
+}
+
+// parseAccept splits an Accept header into media ranges, quality defaults to 1
+// and malformed ranges are skipped
+func parseAccept(header string) []acceptRange {
+	ranges := []acceptRange{}
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+
+		slash := strings.Index(mediaType, "/")
+		if slash <= 0 || slash == len(mediaType)-1 {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+
+			q, err := strconv.ParseFloat(param[2:], 64)
+			if err == nil && q >= 0 && q <= 1 {
+				quality = q
+			}
+		}
+
+		ranges = append(ranges, acceptRange{mediaType[:slash], mediaType[slash+1:], quality})
+	}
+
+	return ranges
+}
+
+// qualityOf returns quality the client assigned to mediaType, taken from the most
+// specific range matching it, and how specific that range was (0 for */*,
+// 1 for type/*, 2 for an exact match), -1 means no range matched
+func qualityOf(ranges []acceptRange, mediaType string) (float64, int) {
+	mediaType = strings.ToLower(mediaType)
+	slash := strings.Index(mediaType, "/")
+	if slash < 0 {
+		return 0, -1
+	}
+	typ, subtype := mediaType[:slash], mediaType[slash+1:]
+
+	quality, specificity := 0.0, -1
+	for _, r := range ranges {
+		s := -1
+		switch {
+		case r.Type == typ && r.Subtype == subtype:
+			s = 2
+		case r.Type == typ && r.Subtype == "*":
+			s = 1
+		case r.Type == "*" && r.Subtype == "*":
+			s = 0
+		}
+
+		if s > specificity {
+			quality, specificity = r.Quality, s
+		}
+	}
+
+	return quality, specificity
+}
+
+// negotiate picks the target of a media type the client prefers the most
+// Ties are resolved in favour of more specific matches and then alphabetically,
+// media types with quality 0 are never picked
+// A missing or empty Accept header accepts anything, like */* does
+func negotiate(header string, targets map[string]string) (string, bool) {
+	if strings.TrimSpace(header) == "" {
+		header = "*/*"
+	}
+
+	ranges := parseAccept(header)
+
+	mediaTypes := make([]string, 0, len(targets))
+	for mediaType := range targets {
+		mediaTypes = append(mediaTypes, mediaType)
+	}
+	sort.Strings(mediaTypes)
+
+	best, bestQuality, bestSpecificity := "", 0.0, -1
+	for _, mediaType := range mediaTypes {
+		quality, specificity := qualityOf(ranges, mediaType)
+		if quality == 0 {
+			continue
+		}
+
+		if quality > bestQuality || (quality == bestQuality && specificity > bestSpecificity) {
+			best, bestQuality, bestSpecificity = mediaType, quality, specificity
+		}
+	}
+
+	if best == "" {
+		return "", false
+	}
+
+	return targets[best], true
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// accessLog writes one line per request, along with other logs to log_file or
+// stdout
+var accessLog = log.New(logOutput, "", 0)
+
+// AccessLogEntry describes a single served request
+type AccessLogEntry struct {
+	Time      time.Time `json:"time"`
+	ClientIP  string    `json:"client_ip"`
+	Method    string    `json:"method"`
+	URI       string    `json:"uri"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int       `json:"bytes"`
+	Referer   string    `json:"referer"`
+	UserAgent string    `json:"user_agent"`
+	Route     string    `json:"route"`
+	Target    string    `json:"target"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// responseRecorder records what was written to a response
+// Route handlers fill in the route, so access log entries can be correlated with it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+	route  string
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the original writer, e.g. to flush
+func (w *responseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// withAccessLog logs requests served by next in the format of access_log
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format := currentConfig().AccessLog
+		if format == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		entry := AccessLogEntry{
+			Time:      start,
+			ClientIP:  clientIP(r),
+			Method:    r.Method,
+			URI:       r.RequestURI,
+			Proto:     r.Proto,
+			Status:    recorder.status,
+			Bytes:     recorder.bytes,
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+			Route:     recorder.route,
+			Target:    recorder.Header().Get("Location"),
+			RequestID: requestID(r.Context()),
+		}
+
+		if format == "json" {
+			line, err := json.Marshal(entry)
+			if err == nil {
+				accessLog.Println(string(line))
+			}
+			return
+		}
+
+		accessLog.Println(entry.combined())
+	})
+}
+
+// combined formats the entry in Apache Combined Log Format, followed by
+// the route, redirect target and request ID
+func (e AccessLogEntry) combined() string {
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = fmt.Sprint(e.Bytes)
+	}
+
+	return fmt.Sprintf("%s - - [%s] %q %d %s %q %q %q %q %q",
+		e.ClientIP, e.Time.Format("02/Jan/2006:15:04:05 -0700"), e.Method+" "+e.URI+" "+e.Proto,
+		e.Status, bytes, orDash(e.Referer), orDash(e.UserAgent), orDash(e.Route), orDash(e.Target), orDash(e.RequestID))
+}
+
+// orDash returns "-" in place of empty values, as the format does
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+
+	return value
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// AdminConfig configures the HTTP admin endpoints, they're only served when
+// a token (here or in TOASTED_ADMIN_TOKEN) or basic_auth is set
+// The token can be a file: or env: secret, resolved by load
+// Requests need either the bearer token or basic credentials, independently
+// of basic_auth of routes
+type AdminConfig struct {
+	Token       string           `yaml:"token,omitempty"`
+	BasicAuth   *BasicAuthConfig `yaml:"basic_auth,omitempty"`
+	ReloadPath  string           `yaml:"reload_path,omitempty"`
+	ExplainPath string           `yaml:"explain_path,omitempty"`
+	RoutesPath  string           `yaml:"routes_path,omitempty"`
+}
+
+// enabled tells whether the admin endpoints are served
+func (a AdminConfig) enabled() bool {
+	return a.token() != "" || a.BasicAuth != nil
+}
+
+// token returns the bearer token required by admin endpoints
+func (a AdminConfig) token() string {
+	if a.Token != "" {
+		return a.Token
+	}
+
+	return os.Getenv("TOASTED_ADMIN_TOKEN")
+}
+
+// load resolves the token, the one of TOASTED_ADMIN_TOKEN too, and the basic
+// credentials, it's done on startup and reload
+func (a *AdminConfig) load() error {
+	if token := a.token(); token != "" {
+		resolved, err := resolveSecret(token)
+		if err != nil {
+			return fmt.Errorf("token: %v", err)
+		}
+		a.Token = resolved
+	}
+
+	if a.BasicAuth != nil {
+		err := a.BasicAuth.load()
+		if err != nil {
+			return fmt.Errorf("basic_auth: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// reloadPath returns path of the reload endpoint, /admin/reload unless configured
+func (a AdminConfig) reloadPath() string {
+	if a.ReloadPath == "" {
+		return "/admin/reload"
+	}
+
+	return a.ReloadPath
+}
+
+// explainPath returns path of the explain endpoint, /admin/explain unless configured
+func (a AdminConfig) explainPath() string {
+	if a.ExplainPath == "" {
+		return "/admin/explain"
+	}
+
+	return a.ExplainPath
+}
+
+// routesPath returns the prefix of the route toggle endpoints, /admin/routes
+// unless configured
+func (a AdminConfig) routesPath() string {
+	if a.RoutesPath == "" {
+		return "/admin/routes"
+	}
+
+	return a.RoutesPath
+}
+
+// authorized checks the bearer token or basic credentials of an admin request,
+// answering with 401 if they're missing or wrong
+func (a AdminConfig) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if token := a.token(); token != "" {
+		expected := []byte("Bearer " + token)
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) == 1 {
+			return true
+		}
+
+		w.Header().Add("WWW-Authenticate", `Bearer realm="toasted"`)
+	}
+
+	if a.BasicAuth != nil {
+		if a.BasicAuth.valid(r) {
+			return true
+		}
+
+		a.BasicAuth.challenge(w)
+	}
+
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	return false
+}
+
+// protect lets only authorized admin requests through to next
+func (a AdminConfig) protect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.authorized(w, r) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// adminReload reloads the config like SIGHUP does, responding with the result
+func adminReload(admin AdminConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !admin.authorized(w, r) {
+			return
+		}
+
+		slog.InfoContext(r.Context(), "Reloading config", "path", configSource, "trigger", "admin")
+
+		err := reload(configSource)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Config reload failed, keeping the current one", "error", err)
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		slog.InfoContext(r.Context(), "Config reloaded")
+		fmt.Fprintln(w, "Config reloaded")
+	}
+}
+
+// adminToggleRoute enables or disables a route until the next reload, on POST
+// to <routes_path>/<route path>/enable or /disable
+func adminToggleRoute(admin AdminConfig) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if !admin.authorized(w, r) {
+			return
+		}
+
+		path, enabled := ps.ByName("route"), false
+		switch {
+		case strings.HasSuffix(path, "/enable"):
+			path, enabled = strings.TrimSuffix(path, "/enable"), true
+		case strings.HasSuffix(path, "/disable"):
+			path = strings.TrimSuffix(path, "/disable")
+		default:
+			http.Error(w, "expected <route path>/enable or <route path>/disable", http.StatusNotFound)
+			return
+		}
+
+		err := toggleRoute(path, enabled)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		slog.WarnContext(r.Context(), "Route toggled until the next reload", "route", path, "enabled", enabled)
+		if enabled {
+			fmt.Fprintf(w, "Route %s enabled\n", path)
+		} else {
+			fmt.Fprintf(w, "Route %s disabled\n", path)
+		}
+	}
+}
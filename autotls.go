@@ -0,0 +1,69 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// AutoTLSConfig configures certificates obtained automatically from Let's Encrypt
+type AutoTLSConfig struct {
+	Hosts    []string `yaml:"hosts,omitempty"`
+	CacheDir string   `yaml:"cache_dir,omitempty"`
+}
+
+// Enabled tells whether any hosts are configured
+func (a AutoTLSConfig) Enabled() bool {
+	return len(a.Hosts) > 0
+}
+
+// autoTLS obtains and renews certificates of the configured hosts, answering
+// HTTP-01 challenges on port 80 and redirecting everything else there to HTTPS,
+// permanently with redirect_http_to_https
+// Returned config has to be used by the HTTPS server
+func autoTLS(config *Config) *tls.Config {
+	a := config.AutoTLS
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(a.Hosts...),
+		Cache:      autocert.DirCache(a.CacheDir),
+	}
+
+	// Without a fallback the challenge responder redirects everything else itself,
+	// but only temporarily
+	var fallback http.Handler
+	if config.RedirectHTTPToHTTPS {
+		fallback = httpsRedirect(":443")
+	}
+
+	challenges := newServer(config, manager.HTTPHandler(fallback))
+	challenges.Addr = ":80"
+	go func() {
+		fatal("Challenge server stopped", "error", challenges.ListenAndServe())
+	}()
+
+	slog.Info("Automatic TLS is on", "hosts", a.Hosts, "cache_dir", a.CacheDir)
+	return manager.TLSConfig()
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// BasicAuthConfig requires HTTP Basic credentials before a route evaluates
+// its conditions, users are the inline one and the ones of an htpasswd file
+// with bcrypt or {SHA} hashes
+// User and password can be file: or env: secrets, htpasswd can be env: with
+// the lines in the environment variable
+// The global config applies to routes without their own, Disabled opts a
+// route out of it
+type BasicAuthConfig struct {
+	Realm    string `yaml:"realm,omitempty"`
+	User     string `yaml:"user,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	Htpasswd string `yaml:"htpasswd,omitempty"`
+	Disabled bool   `yaml:"disabled,omitempty"`
+
+	users map[string]func(password string) bool
+}
+
+// load resolves the credentials and reads the htpasswd file, it's done on
+// startup and reload
+func (a *BasicAuthConfig) load() error {
+	a.users = map[string]func(string) bool{}
+	if a.Disabled {
+		return nil
+	}
+
+	if (a.User == "") != (a.Password == "") {
+		return fmt.Errorf("user and password have to be set together")
+	}
+
+	if a.User != "" {
+		user, err := resolveSecret(a.User)
+		if err != nil {
+			return fmt.Errorf("user: %v", err)
+		}
+		password, err := resolveSecret(a.Password)
+		if err != nil {
+			return fmt.Errorf("password: %v", err)
+		}
+
+		expected := sha256.Sum256([]byte(password))
+		a.users[user] = func(password string) bool {
+			// Hashed first, so the comparison doesn't leak the length
+			actual := sha256.Sum256([]byte(password))
+			return subtle.ConstantTimeCompare(actual[:], expected[:]) == 1
+		}
+	}
+
+	if a.Htpasswd != "" {
+		err := a.loadHtpasswd()
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(a.users) == 0 {
+		return fmt.Errorf("no users, set user and password or htpasswd")
+	}
+
+	return nil
+}
+
+// loadHtpasswd adds users of the htpasswd file or environment variable
+func (a *BasicAuthConfig) loadHtpasswd() error {
+	if strings.HasPrefix(a.Htpasswd, "env:") {
+		lines, err := resolveSecret(a.Htpasswd)
+		if err != nil {
+			return fmt.Errorf("htpasswd: %v", err)
+		}
+
+		return a.parseHtpasswd(strings.TrimPrefix(a.Htpasswd, "env:"), strings.NewReader(lines))
+	}
+
+	path := strings.TrimPrefix(a.Htpasswd, "file:")
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return a.parseHtpasswd(path, file)
+}
+
+// parseHtpasswd adds users of user:hash lines read from r, name is where
+// they come from in errors
+func (a *BasicAuthConfig) parseHtpasswd(name string, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected user:hash", name, n)
+		}
+
+		switch {
+		case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+			hash := []byte(hash)
+			a.users[user] = func(password string) bool {
+				return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+			}
+		case strings.HasPrefix(hash, "{SHA}"):
+			expected, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(hash, "{SHA}"))
+			if err != nil {
+				return fmt.Errorf("%s:%d: invalid {SHA} hash", name, n)
+			}
+			a.users[user] = func(password string) bool {
+				actual := sha1.Sum([]byte(password))
+				return subtle.ConstantTimeCompare(actual[:], expected) == 1
+			}
+		default:
+			return fmt.Errorf("%s:%d: only bcrypt and {SHA} hashes are supported", name, n)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// authorized checks credentials of a request, answering with 401 if they're
+// missing or wrong
+func (a *BasicAuthConfig) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if a.Disabled || a.valid(r) {
+		return true
+	}
+
+	a.challenge(w)
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	return false
+}
+
+// valid tells whether the request has credentials of one of the users
+func (a *BasicAuthConfig) valid(r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	check, known := a.users[user]
+	return known && check(password)
+}
+
+// challenge asks the client for credentials
+func (a *BasicAuthConfig) challenge(w http.ResponseWriter) {
+	realm := a.Realm
+	if realm == "" {
+		realm = "toasted"
+	}
+
+	w.Header().Add("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, realm))
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeHtpasswd writes lines to an htpasswd file in a temporary directory
+func writeHtpasswd(t *testing.T, lines ...string) string {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestBasicAuthPasswords(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("bcrypt-secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shaSum := sha1.Sum([]byte("sha-secret"))
+
+	auth := BasicAuthConfig{
+		User:     "admin",
+		Password: "inline-secret",
+		Htpasswd: writeHtpasswd(t,
+			"# users",
+			"",
+			"bob:"+string(bcryptHash),
+			"carol:{SHA}"+base64.StdEncoding.EncodeToString(shaSum[:]),
+		),
+	}
+	err = auth.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		valid    bool
+	}{
+		{name: "inline user", user: "admin", password: "inline-secret", valid: true},
+		{name: "inline user with a wrong password", user: "admin", password: "inline"},
+		{name: "bcrypt user", user: "bob", password: "bcrypt-secret", valid: true},
+		{name: "bcrypt user with a wrong password", user: "bob", password: "sha-secret"},
+		{name: "{SHA} user", user: "carol", password: "sha-secret", valid: true},
+		{name: "{SHA} user with a wrong password", user: "carol", password: "bcrypt-secret"},
+		{name: "unknown user", user: "mallory", password: "inline-secret"},
+		{name: "empty password", user: "admin"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/go", nil)
+			req.SetBasicAuth(test.user, test.password)
+
+			if valid := auth.valid(req); valid != test.valid {
+				t.Fatalf("expected valid to be %v, got %v", test.valid, valid)
+			}
+		})
+	}
+
+	t.Run("no credentials", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		if auth.authorized(w, httptest.NewRequest("GET", "/go", nil)) {
+			t.Fatal("expected a request without credentials to be unauthorized")
+		}
+		if w.Code != 401 || !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Basic ") {
+			t.Fatalf("expected a 401 Basic challenge, got %d %q", w.Code, w.Header().Get("WWW-Authenticate"))
+		}
+	})
+}
+
+func TestBasicAuthHtpasswdProblems(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		problem string
+	}{
+		{name: "line without a hash", line: "alice", problem: ":1: expected user:hash"},
+		{name: "apr1 hash", line: "alice:$apr1$salt$hash", problem: ":1: only bcrypt and {SHA} hashes are supported"},
+		{name: "plain text password", line: "alice:secret", problem: ":1: only bcrypt and {SHA} hashes are supported"},
+		{name: "{SHA} hash that isn't base64", line: "alice:{SHA}not base64!", problem: ":1: invalid {SHA} hash"},
+		{name: "only comments", line: "# alice:secret", problem: "no users"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			auth := BasicAuthConfig{Htpasswd: writeHtpasswd(t, test.line)}
+
+			err := auth.load()
+			if err == nil || !strings.Contains(err.Error(), test.problem) {
+				t.Fatalf("expected problem %q, got %v", test.problem, err)
+			}
+		})
+	}
+}
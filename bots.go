@@ -0,0 +1,114 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// defaultBotSignatures are lowercase substrings of User-Agents of well-known
+// crawlers, link previewers, monitoring and HTTP tools
+var defaultBotSignatures = []string{
+	"bot",
+	"crawl",
+	"spider",
+	"slurp",
+	"archiver",
+	"facebookexternalhit",
+	"facebookcatalog",
+	"embedly",
+	"quora link preview",
+	"outbrain",
+	"pinterest",
+	"vkshare",
+	"w3c_validator",
+	"whatsapp",
+	"flipboard",
+	"tumblr",
+	"skypeuripreview",
+	"nuzzel",
+	"qwantify",
+	"bingpreview",
+	"mediapartners-google",
+	"google-inspectiontool",
+	"lighthouse",
+	"headlesschrome",
+	"phantomjs",
+	"pingdom",
+	"uptimerobot",
+	"curl/",
+	"wget/",
+	"python-requests",
+	"python-urllib",
+	"go-http-client",
+	"java/",
+	"okhttp",
+	"libwww-perl",
+	"scrapy",
+	"httpclient",
+}
+
+// BotConfig adjusts the list of User-Agent substrings User-Agent:bot
+// conditions look for, Signatures replace the default ones and Extra are
+// added to them, all compared case-insensitively
+type BotConfig struct {
+	Signatures []string `yaml:"signatures,omitempty"`
+	Extra      []string `yaml:"extra,omitempty"`
+
+	signatures []string
+}
+
+// load puts together the list of signatures
+func (b *BotConfig) load() error {
+	signatures := defaultBotSignatures
+	if len(b.Signatures) > 0 {
+		signatures = b.Signatures
+	}
+
+	b.signatures = nil
+	for _, signature := range append(append([]string{}, signatures...), b.Extra...) {
+		signature = strings.ToLower(strings.TrimSpace(signature))
+		if signature == "" {
+			return fmt.Errorf("empty signature")
+		}
+		b.signatures = append(b.signatures, signature)
+	}
+
+	return nil
+}
+
+// isBot tells whether userAgent contains any of the signatures, requests
+// without a User-Agent are most likely not from a browser either
+func (b *BotConfig) isBot(userAgent string) bool {
+	if userAgent == "" {
+		return true
+	}
+
+	userAgent = strings.ToLower(userAgent)
+	for _, signature := range b.signatures {
+		if strings.Contains(userAgent, signature) {
+			return true
+		}
+	}
+
+	return false
+}
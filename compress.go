@@ -0,0 +1,183 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultCompressMinBytes is the smallest body compressed unless
+// compress_min_bytes is set
+const defaultCompressMinBytes = 1024
+
+// compressMinBytes returns the smallest body of the route compressed with
+// gzip, its own compress_min_bytes or the global one, 0 if compression is off
+func (r Route) compressMinBytes(config *Config) int {
+	minBytes := r.CompressMinBytes
+	if minBytes == 0 {
+		minBytes = config.CompressMinBytes
+	}
+
+	switch {
+	case minBytes < 0:
+		return 0
+	case minBytes == 0:
+		return defaultCompressMinBytes
+	}
+
+	return minBytes
+}
+
+// acceptsGzip tells whether the Accept-Encoding header of req allows gzip
+func acceptsGzip(req *http.Request) bool {
+	for _, part := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil && strings.HasPrefix(param, "q=") {
+				quality = q
+			}
+		}
+
+		if quality > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// compressWriter gzips a response once its body reaches minBytes, smaller
+// bodies are written as they are
+// The body is held back until then, so it has to be closed to write the rest
+type compressWriter struct {
+	http.ResponseWriter
+	minBytes int
+	accepted bool
+
+	status  int
+	pending []byte
+	started bool
+	gz      *gzip.Writer
+}
+
+// newCompressWriter wraps w for req, the response varies by Accept-Encoding
+// whether it ends up compressed or not
+func newCompressWriter(w http.ResponseWriter, req *http.Request, minBytes int) *compressWriter {
+	w.Header().Add("Vary", "Accept-Encoding")
+	return &compressWriter{ResponseWriter: w, minBytes: minBytes, accepted: acceptsGzip(req)}
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.started {
+		if w.gz != nil {
+			return w.gz.Write(b)
+		}
+		return w.ResponseWriter.Write(b)
+	}
+
+	w.pending = append(w.pending, b...)
+	if len(w.pending) >= w.minBytes {
+		err := w.start()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+// start writes the headers, compressing the rest of the response if the
+// pending body is large enough, the client accepts gzip and the body isn't
+// encoded already
+func (w *compressWriter) start() error {
+	w.started = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	header := w.Header()
+	if w.accepted && len(w.pending) >= w.minBytes && header.Get("Content-Encoding") == "" {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+
+	pending := w.pending
+	w.pending = nil
+	if w.gz != nil {
+		_, err := w.gz.Write(pending)
+		return err
+	}
+
+	_, err := w.ResponseWriter.Write(pending)
+	return err
+}
+
+// Flush sends what was written so far, a body flushed before reaching
+// minBytes isn't compressed, so streamed responses aren't held back
+func (w *compressWriter) Flush() {
+	if !w.started {
+		w.start()
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Close writes what's held back and finishes the compressed body
+func (w *compressWriter) Close() error {
+	if !w.started {
+		err := w.start()
+		if err != nil {
+			return err
+		}
+	}
+
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+
+	return nil
+}
+
+// Unwrap lets http.ResponseController reach the original writer
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
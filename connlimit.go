@@ -0,0 +1,188 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// connLimitListener wraps a net.Listener limiting the number of simultaneous
+// connections from a single client IP
+// Connections over the limit are either closed right after being accepted
+// or queued until one of the connections from the same IP is closed, for at
+// most queueTimeout
+type connLimitListener struct {
+	net.Listener
+	limit        int
+	queue        bool
+	queueTimeout time.Duration
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	active map[string]int
+}
+
+func newConnLimitListener(l net.Listener, limit int, queue bool, queueTimeout time.Duration) *connLimitListener {
+	if queueTimeout <= 0 {
+		queueTimeout = 10 * time.Second
+	}
+
+	cl := &connLimitListener{
+		Listener:     l,
+		limit:        limit,
+		queue:        queue,
+		queueTimeout: queueTimeout,
+		active:       map[string]int{},
+	}
+	cl.cond = sync.NewCond(&cl.mu)
+	return cl
+}
+
+// Accept waits for and returns the next connection within the limit
+func (l *connLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			ip = conn.RemoteAddr().String()
+		}
+
+		lc := &limitedConn{Conn: conn, listener: l, ip: ip}
+
+		// Queued connections are handed to the server right away, but block on
+		// their first read until a slot for their IP frees up
+		if l.queue {
+			return lc, nil
+		}
+
+		if !l.tryAcquire(lc) {
+			slog.Debug("Connection limit reached, rejecting connection", "ip", ip)
+			conn.Close()
+			continue
+		}
+
+		return lc, nil
+	}
+}
+
+func (l *connLimitListener) tryAcquire(c *limitedConn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active[c.ip] >= l.limit {
+		return false
+	}
+
+	l.active[c.ip]++
+	c.acquired = true
+	return true
+}
+
+// acquire waits for a free slot unless c already holds one, it returns false
+// if c got closed in the meantime or no slot freed up within queueTimeout
+func (l *connLimitListener) acquire(c *limitedConn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !c.acquired && !c.closed && l.active[c.ip] >= l.limit {
+		expired := false
+		timer := time.AfterFunc(l.queueTimeout, func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			expired = true
+			l.cond.Broadcast()
+		})
+		defer timer.Stop()
+
+		for !c.closed && !expired && l.active[c.ip] >= l.limit {
+			l.cond.Wait()
+		}
+
+		if expired && !c.closed && l.active[c.ip] >= l.limit {
+			slog.Debug("Connection queue timed out", "ip", c.ip)
+			return false
+		}
+	}
+
+	if c.closed {
+		return false
+	}
+
+	if !c.acquired {
+		l.active[c.ip]++
+		c.acquired = true
+	}
+
+	return true
+}
+
+func (l *connLimitListener) release(c *limitedConn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
+
+	if c.acquired {
+		l.active[c.ip]--
+		if l.active[c.ip] <= 0 {
+			delete(l.active, c.ip)
+		}
+	}
+
+	l.cond.Broadcast()
+}
+
+// limitedConn gives back its slot to the listener when closed
+type limitedConn struct {
+	net.Conn
+	listener *connLimitListener
+	ip       string
+
+	// Guarded by listener.mu
+	acquired bool
+	closed   bool
+}
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	// Closed right away, so a connection which waited too long gets no response
+	if !c.listener.acquire(c) {
+		c.Conn.Close()
+		return 0, net.ErrClosed
+	}
+
+	return c.Conn.Read(b)
+}
+
+func (c *limitedConn) Close() error {
+	c.listener.release(c)
+	return c.Conn.Close()
+}
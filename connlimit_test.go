@@ -0,0 +1,111 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// acceptPair dials l and returns both ends of the connection, with a byte
+// already sent by the client so reads on the server end don't block on it
+func acceptPair(t *testing.T, l net.Listener) (client, server net.Conn) {
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	_, err = client.Write([]byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err = l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	return client, server
+}
+
+func TestConnLimitQueueTimeout(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inner.Close()
+
+	queueTimeout := 100 * time.Millisecond
+	l := newConnLimitListener(inner, 1, true, queueTimeout)
+
+	_, first := acceptPair(t, l)
+	_, err = first.Read(make([]byte, 1))
+	if err != nil {
+		t.Fatalf("expected the first connection to be served, got %v", err)
+	}
+
+	client, queued := acceptPair(t, l)
+	start := time.Now()
+	_, err = queued.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatal("expected the queued connection to be rejected")
+	}
+	if waited := time.Since(start); waited < queueTimeout {
+		t.Fatalf("expected the queued connection to wait %v, rejected after %v", queueTimeout, waited)
+	}
+
+	// Closed without a response
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := client.Read(make([]byte, 1))
+	if n != 0 || err == nil {
+		t.Fatalf("expected the client to be disconnected, got %d bytes and %v", n, err)
+	}
+	if timeout, ok := err.(net.Error); ok && timeout.Timeout() {
+		t.Fatal("expected the client to be disconnected, the connection is still open")
+	}
+}
+
+func TestConnLimitQueueFreedSlot(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inner.Close()
+
+	l := newConnLimitListener(inner, 1, true, time.Second)
+
+	_, first := acceptPair(t, l)
+	_, err = first.Read(make([]byte, 1))
+	if err != nil {
+		t.Fatalf("expected the first connection to be served, got %v", err)
+	}
+
+	_, queued := acceptPair(t, l)
+	time.AfterFunc(50*time.Millisecond, func() { first.Close() })
+
+	_, err = queued.Read(make([]byte, 1))
+	if err != nil {
+		t.Fatalf("expected the queued connection to get the freed slot, got %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SetCookie is a cookie written on redirects of a route, its value can refer
+// to path parameters (:name) and groups of the last passed matches condition
+// ($1, $2, ...) like targets can
+type SetCookie struct {
+	Name     string        `yaml:"name"`
+	Value    string        `yaml:"value"`
+	MaxAge   time.Duration `yaml:"max_age,omitempty"`
+	Path     string        `yaml:"path,omitempty"`
+	Domain   string        `yaml:"domain,omitempty"`
+	Secure   bool          `yaml:"secure,omitempty"`
+	HTTPOnly bool          `yaml:"http_only,omitempty"`
+}
+
+// validCookieName tells whether name can be used as a cookie name
+func validCookieName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "()<>@,;:\\\"/[]?={} \t\r\n")
+}
+
+// cookie builds the cookie with value, the configured one with path
+// parameters and submatches filled in
+// Without max_age it lasts until the browser closes, path defaults to /
+func (s SetCookie) cookie(value string) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     s.Name,
+		Value:    value,
+		Path:     s.Path,
+		Domain:   s.Domain,
+		Secure:   s.Secure,
+		HttpOnly: s.HTTPOnly,
+	}
+
+	if cookie.Path == "" {
+		cookie.Path = "/"
+	}
+	if s.MaxAge > 0 {
+		cookie.MaxAge = int(s.MaxAge.Seconds())
+	}
+
+	return cookie
+}
+
+// cookieValue returns the value of the request cookie name, percent-decoded
+// like document.cookie writers (encodeURIComponent) encode it, a + stays as
+// it is. Values which don't decode are returned as sent
+// Missing and malformed cookies are both treated as empty
+func cookieValue(req *http.Request, name string) string {
+	cookie, err := req.Cookie(name)
+	if err != nil {
+		return ""
+	}
+
+	value, err := url.PathUnescape(cookie.Value)
+	if err != nil {
+		return cookie.Value
+	}
+
+	return value
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig lets browsers on other origins fetch a route
+// AllowedMethods default to allowed_methods of the route, AllowedHeaders to
+// whatever headers the preflight request asks for
+type CORSConfig struct {
+	AllowedOrigins   []string      `yaml:"allowed_origins"`
+	AllowedMethods   []string      `yaml:"allowed_methods,omitempty"`
+	AllowedHeaders   []string      `yaml:"allowed_headers,omitempty"`
+	AllowCredentials bool          `yaml:"allow_credentials,omitempty"`
+	MaxAge           time.Duration `yaml:"max_age,omitempty"`
+}
+
+// allowOrigin sets Access-Control-Allow-Origin if the request comes from an
+// allowed origin, it returns whether it does
+func (c *CORSConfig) allowOrigin(w http.ResponseWriter, req *http.Request) bool {
+	w.Header().Add("Vary", "Origin")
+
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+
+	for _, allowed := range c.AllowedOrigins {
+		// Validation rejects * along with allow_credentials
+		if allowed == "*" {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			return true
+		}
+
+		if strings.EqualFold(allowed, origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			if c.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			return true
+		}
+	}
+
+	return false
+}
+
+// check returns an error if the config would let any site make credentialed
+// requests
+func (c *CORSConfig) check() error {
+	if !c.AllowCredentials {
+		return nil
+	}
+
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" {
+			return fmt.Errorf("allow_credentials requires explicit allowed_origins, not *")
+		}
+	}
+
+	return nil
+}
+
+// preflight answers OPTIONS requests browsers send before the actual ones
+func (c *CORSConfig) preflight(methods []string) http.HandlerFunc {
+	if len(c.AllowedMethods) > 0 {
+		methods = c.AllowedMethods
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if c.allowOrigin(w, req) {
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+
+			if len(c.AllowedHeaders) > 0 {
+				w.Header().Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+			} else if requested := req.Header.Get("Access-Control-Request-Headers"); requested != "" {
+				w.Header().Set("Access-Control-Allow-Headers", requested)
+			}
+
+			if c.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+			}
+		}
+
+		w.Header().Set("Allow", strings.Join(append([]string{"OPTIONS"}, methods...), ", "))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCORSPreflight(t *testing.T) {
+	tests := []struct {
+		name        string
+		cors        CORSConfig
+		origin      string
+		headers     string
+		allowOrigin string
+		credentials string
+		allowHeader string
+	}{
+		{
+			name:        "wildcard origin",
+			cors:        CORSConfig{AllowedOrigins: []string{"*"}},
+			origin:      "https://evil.example.com",
+			allowOrigin: "*",
+		},
+		{
+			// Rejected by validation, the origin mustn't be echoed with
+			// credentials allowed if it gets through anyway
+			name:        "wildcard origin with allow_credentials",
+			cors:        CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true},
+			origin:      "https://evil.example.com",
+			allowOrigin: "*",
+		},
+		{
+			name:        "explicit origin with allow_credentials",
+			cors:        CORSConfig{AllowedOrigins: []string{"https://app.example.com"}, AllowCredentials: true},
+			origin:      "https://APP.example.com",
+			allowOrigin: "https://APP.example.com",
+			credentials: "true",
+		},
+		{
+			name:   "origin that isn't allowed",
+			cors:   CORSConfig{AllowedOrigins: []string{"https://app.example.com"}, AllowCredentials: true},
+			origin: "https://evil.example.com",
+		},
+		{
+			name:        "requested headers without allowed_headers",
+			cors:        CORSConfig{AllowedOrigins: []string{"https://app.example.com"}},
+			origin:      "https://app.example.com",
+			headers:     "X-Requested-With, Content-Type",
+			allowOrigin: "https://app.example.com",
+			allowHeader: "X-Requested-With, Content-Type",
+		},
+		{
+			name:        "requested headers with allowed_headers",
+			cors:        CORSConfig{AllowedOrigins: []string{"https://app.example.com"}, AllowedHeaders: []string{"Content-Type"}},
+			origin:      "https://app.example.com",
+			headers:     "X-Requested-With, Content-Type",
+			allowOrigin: "https://app.example.com",
+			allowHeader: "Content-Type",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("OPTIONS", "/go", nil)
+			req.Header.Set("Origin", test.origin)
+			req.Header.Set("Access-Control-Request-Method", "GET")
+			if test.headers != "" {
+				req.Header.Set("Access-Control-Request-Headers", test.headers)
+			}
+			w := httptest.NewRecorder()
+			test.cors.preflight([]string{"GET"}).ServeHTTP(w, req)
+
+			if w.Code != 204 {
+				t.Fatalf("expected status 204, got %d", w.Code)
+			}
+
+			expected := map[string]string{
+				"Access-Control-Allow-Origin":      test.allowOrigin,
+				"Access-Control-Allow-Credentials": test.credentials,
+				"Access-Control-Allow-Headers":     test.allowHeader,
+			}
+			for name, value := range expected {
+				if actual := w.Header().Get(name); actual != value {
+					t.Errorf("expected %s %q, got %q", name, value, actual)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateCORSCredentials(t *testing.T) {
+	wildcard := &CORSConfig{AllowedOrigins: []string{"https://app.example.com", "*"}, AllowCredentials: true}
+	route := Route{
+		AllowedMethods:  []string{"GET"},
+		SuccessRedirect: "/success",
+		FailureRedirect: "/failure",
+	}
+
+	global := Config{CORS: wildcard, Routes: map[string]Route{"/go": route}}
+	err := global.Validate()
+	if err == nil || !strings.Contains(err.Error(), "cors: allow_credentials requires explicit allowed_origins") {
+		t.Fatalf("expected a global cors problem, got %v", err)
+	}
+
+	route.CORS = wildcard
+	perRoute := Config{Routes: map[string]Route{"/go": route}}
+	err = perRoute.Validate()
+	if err == nil || !strings.Contains(err.Error(), `route "/go": cors: allow_credentials requires explicit allowed_origins`) {
+		t.Fatalf("expected a cors problem of the route, got %v", err)
+	}
+}
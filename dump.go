@@ -0,0 +1,135 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+)
+
+// ConditionDump is a parsed condition as printed by -dump
+type ConditionDump struct {
+	Raw                string `json:"raw"`
+	Subject            string `json:"subject"`
+	Key                string `json:"key,omitempty"`
+	Operator           string `json:"operator"`
+	Expected           string `json:"expected"`
+	Label              string `json:"label,omitempty"`
+	ShortCircuitTarget string `json:"short_circuit_target,omitempty"`
+	FailureRedirect    string `json:"failure_redirect,omitempty"`
+}
+
+// GroupDump is a group of conditions as printed by -dump
+type GroupDump struct {
+	Match      string          `json:"match"`
+	Conditions []ConditionDump `json:"conditions"`
+	Groups     []GroupDump     `json:"groups,omitempty"`
+}
+
+// RouteDump is a route as printed by -dump, with defaults filled in
+type RouteDump struct {
+	Path            string            `json:"path"`
+	Enabled         bool              `json:"enabled"`
+	Methods         []string          `json:"methods"`
+	Match           string            `json:"match"`
+	Invert          bool              `json:"invert,omitempty"`
+	Conditions      []ConditionDump   `json:"conditions"`
+	Groups          []GroupDump       `json:"groups,omitempty"`
+	SuccessRedirect string            `json:"success_redirect,omitempty"`
+	Targets         []Target          `json:"targets,omitempty"`
+	Strategy        string            `json:"strategy,omitempty"`
+	AcceptRedirects map[string]string `json:"accept_redirects,omitempty"`
+	ProxyTo         string            `json:"proxy_to,omitempty"`
+	RespondStatus   int               `json:"respond_status,omitempty"`
+	FailureRedirect string            `json:"failure_redirect"`
+	RedirectStatus  int               `json:"redirect_status"`
+}
+
+// dumpGroup describes a parsed group and its nested groups
+func dumpGroup(g *Group) GroupDump {
+	dump := GroupDump{Match: g.Match, Conditions: []ConditionDump{}}
+	if dump.Match == "" {
+		dump.Match = "all"
+	}
+
+	for _, c := range g.Conditions {
+		dump.Conditions = append(dump.Conditions, ConditionDump{
+			Raw:                c.Raw,
+			Subject:            c.Type,
+			Key:                c.Key,
+			Operator:           c.Operator,
+			Expected:           c.Expected,
+			Label:              c.Label,
+			ShortCircuitTarget: c.ShortCircuitTarget,
+			FailureRedirect:    c.FailureRedirect,
+		})
+	}
+
+	for _, group := range g.Groups {
+		dump.Groups = append(dump.Groups, dumpGroup(group))
+	}
+
+	return dump
+}
+
+// dumpRoutes writes routes of the validated config as JSON sorted by path
+func dumpRoutes(w io.Writer, c *Config) error {
+	paths := make([]string, 0, len(c.Routes))
+	for path := range c.Routes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	routes := []RouteDump{}
+	for _, path := range paths {
+		route := c.Routes[path]
+		group := dumpGroup(route.group())
+		dump := RouteDump{
+			Path:            path,
+			Enabled:         route.enabled(),
+			Methods:         route.AllowedMethods,
+			Match:           group.Match,
+			Invert:          route.Invert,
+			Conditions:      group.Conditions,
+			Groups:          group.Groups,
+			SuccessRedirect: route.SuccessRedirect,
+			Targets:         route.Targets,
+			Strategy:        route.Strategy,
+			AcceptRedirects: route.AcceptRedirects,
+			ProxyTo:         route.ProxyTo,
+			FailureRedirect: route.FailureRedirect,
+			RedirectStatus:  route.RedirectStatus,
+		}
+		if len(route.Targets) > 0 && dump.Strategy == "" {
+			dump.Strategy = "weighted"
+		}
+		if route.Respond != nil {
+			dump.RespondStatus = route.Respond.Status
+		}
+
+		routes = append(routes, dump)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(map[string][]RouteDump{"routes": routes})
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// EventsConfig configures publishing of redirect decisions
+type EventsConfig struct {
+	Webhook   string        `yaml:"webhook,omitempty"`
+	QueueSize int           `yaml:"queue_size,omitempty"`
+	Timeout   time.Duration `yaml:"timeout,omitempty"`
+}
+
+// DecisionEvent describes how a single routed request was resolved
+type DecisionEvent struct {
+	Time      time.Time `json:"time"`
+	Route     string    `json:"route"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	ClientIP  string    `json:"client_ip"`
+	UserAgent string    `json:"user_agent"`
+	Result    string    `json:"result"`
+	Target    string    `json:"target"`
+	Status    int       `json:"status"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// EventSink delivers decision events to an external system
+// Send is only ever called from a single goroutine, so sinks don't have to be
+// safe for concurrent use
+type EventSink interface {
+	Send(event DecisionEvent) error
+}
+
+// WebhookSink POSTs every event as JSON to a URL
+type WebhookSink struct {
+	URL    string
+	Client *http.Client
+}
+
+// Send implements EventSink
+func (s WebhookSink) Send(event DecisionEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.Client.Post(s.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+
+	return nil
+}
+
+// eventQueue buffers events in front of a sink so publishing never blocks the
+// request path, events which don't fit into the queue are dropped
+type eventQueue struct {
+	sink    EventSink
+	events  chan DecisionEvent
+	dropped *expvar.Int
+}
+
+func newEventQueue(sink EventSink, size int) *eventQueue {
+	q := &eventQueue{
+		sink:    sink,
+		events:  make(chan DecisionEvent, size),
+		dropped: expvar.NewInt("events_dropped"),
+	}
+	expvar.Publish("events_queue_depth", expvar.Func(func() interface{} {
+		return len(q.events)
+	}))
+
+	go q.run()
+	return q
+}
+
+// Publish queues the event or drops it if the queue is full
+func (q *eventQueue) Publish(event DecisionEvent) {
+	select {
+	case q.events <- event:
+	default:
+		q.dropped.Add(1)
+	}
+}
+
+func (q *eventQueue) run() {
+	for event := range q.events {
+		if err := q.sink.Send(event); err != nil {
+			slog.Warn("Failed sending event", "error", err)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// ConditionTrace is the outcome of a condition checked while explaining
+type ConditionTrace struct {
+	Condition string `json:"condition"`
+	Subject   string `json:"subject"`
+	Expected  string `json:"expected"`
+	Actual    string `json:"actual"`
+	Passed    bool   `json:"passed"`
+}
+
+// Explanation describes how a request would be routed
+type Explanation struct {
+	Method     string            `json:"method"`
+	Path       string            `json:"path"`
+	Route      string            `json:"route,omitempty"`
+	Params     map[string]string `json:"params,omitempty"`
+	Conditions []ConditionTrace  `json:"conditions"`
+	Result     string            `json:"result"`
+	Target     string            `json:"target,omitempty"`
+	Status     int               `json:"status,omitempty"`
+}
+
+// matchRoute finds the route serving method and path along with its path
+// parameters, the root catch-all being the last resort
+func matchRoute(config *Config, method, path string) (string, httprouter.Params, bool) {
+	lookup := httprouter.New()
+	var matched, fallback string
+
+	for pattern, route := range config.Routes {
+		if !route.enabled() {
+			continue
+		}
+
+		if _, ok := rootCatchAll(pattern); ok {
+			fallback = pattern
+			continue
+		}
+
+		pattern := pattern
+		for _, m := range config.methods(route) {
+			lookup.Handle(m, pattern, func(http.ResponseWriter, *http.Request, httprouter.Params) {
+				matched = pattern
+			})
+		}
+	}
+
+	if handle, ps, _ := lookup.Lookup(method, path); handle != nil {
+		handle(nil, nil, ps)
+		return matched, ps, true
+	}
+
+	if fallback != "" {
+		for _, m := range config.methods(config.Routes[fallback]) {
+			if m == method {
+				name, _ := rootCatchAll(fallback)
+				return fallback, httprouter.Params{{Key: name, Value: path}}, true
+			}
+		}
+	}
+
+	return "", nil, false
+}
+
+// explain evaluates conditions of the route matching req and works out where
+// it would be sent, without redirecting, proxying or counting it anywhere
+// Rate limits aren't checked and UAVelocity conditions see a velocity of 0
+func explain(config *Config, req *http.Request) Explanation {
+	explanation := Explanation{Method: req.Method, Path: req.URL.Path, Conditions: []ConditionTrace{}}
+
+	path, ps, ok := matchRoute(config, req.Method, req.URL.Path)
+	if !ok {
+		explanation.Result = "not_found"
+		return explanation
+	}
+
+	route := config.Routes[path]
+	explanation.Route = path
+	if len(ps) > 0 {
+		explanation.Params = map[string]string{}
+		for _, p := range ps {
+			explanation.Params[p.Key] = p.Value
+		}
+	}
+
+	state := &requestState{route: path, tracing: true}
+	req = req.WithContext(context.WithValue(req.Context(), requestStateKey{}, state))
+
+	// Round robin starts over, the real turn isn't advanced
+	var turn uint64
+	d := route.decide(req, ps, &turn)
+	explanation.Conditions = append(explanation.Conditions, state.trace...)
+	explanation.Result, explanation.Target, explanation.Status = d.result, d.target, d.status
+
+	return explanation
+}
+
+// adminExplain answers how a simulated request would be routed, described by
+// query parameters: path (with its query), method (GET by default), ua, ip
+// (of the caller by default), header (Name: value) and cookie (name=value),
+// the last two can be repeated
+func adminExplain(admin AdminConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !admin.authorized(w, r) {
+			return
+		}
+
+		query := r.URL.Query()
+		method := query.Get("method")
+		if method == "" {
+			method = "GET"
+		}
+
+		path := query.Get("path")
+		if !strings.HasPrefix(path, "/") {
+			http.Error(w, "path has to start with /", http.StatusBadRequest)
+			return
+		}
+
+		req, err := http.NewRequestWithContext(r.Context(), method, path, nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		req.Host = r.Host
+		req.RemoteAddr = net.JoinHostPort(clientIP(r), "0")
+		if ip := query.Get("ip"); ip != "" {
+			req.RemoteAddr = net.JoinHostPort(ip, "0")
+		}
+		if ua := query.Get("ua"); ua != "" {
+			req.Header.Set("User-Agent", ua)
+		}
+		for _, header := range query["header"] {
+			name, value, ok := strings.Cut(header, ":")
+			if !ok {
+				http.Error(w, "headers have to be given as Name: value", http.StatusBadRequest)
+				return
+			}
+			req.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+		}
+		for _, cookie := range query["cookie"] {
+			req.Header.Add("Cookie", cookie)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(explain(currentConfig(), req))
+	}
+}
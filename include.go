@@ -0,0 +1,102 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// maxIncludeDepth limits nesting of includes, so include cycles are reported
+// instead of being followed forever
+const maxIncludeDepth = 10
+
+// include merges routes of files matching patterns into the config, following
+// their includes too, relative patterns are resolved against the directory of
+// the including file (or its URL)
+// Only routes are taken from included files, sources maps every route path to
+// the file defining it, so the same path can't be defined twice, root is the
+// top-level config
+func (c *Config) include(root, from string, patterns []string, sources map[string]string, depth int) error {
+	if len(patterns) > 0 && depth > maxIncludeDepth {
+		return fmt.Errorf("includes of %s nest deeper than %d levels, do they include each other?", from, maxIncludeDepth)
+	}
+
+	for _, pattern := range patterns {
+		paths, err := resolveInclude(from, pattern)
+		if err != nil {
+			return fmt.Errorf("%s: include %s: %v", from, pattern, err)
+		}
+
+		for _, path := range paths {
+			included, err := loadFile(path, root)
+			if err != nil {
+				return err
+			}
+
+			for route, conf := range included.Routes {
+				if source, ok := sources[route]; ok {
+					return fmt.Errorf("route %s is defined in both %s and %s", route, source, path)
+				}
+				sources[route] = path
+
+				if c.Routes == nil {
+					c.Routes = map[string]Route{}
+				}
+				c.Routes[route] = conf
+			}
+
+			err = c.include(root, path, included.Include, sources, depth+1)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// resolveInclude returns paths of config files matching an include pattern,
+// includes of remote configs and remote includes aren't globs
+func resolveInclude(from, pattern string) ([]string, error) {
+	if isRemote(pattern) {
+		return []string{pattern}, nil
+	}
+	if isRemote(from) {
+		path, err := resolveRemote(from, pattern)
+		return []string{path}, err
+	}
+
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(from), pattern)
+	}
+
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 && !strings.ContainsAny(pattern, "*?[") {
+		return nil, fmt.Errorf("no such file")
+	}
+
+	return paths, nil
+}
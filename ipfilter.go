@@ -0,0 +1,136 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+)
+
+// IPFilterConfig lets only requests from the Allow ranges (all if empty) and
+// outside of the Deny ranges through, before any routing
+// Rejected requests get Status (403 by default) or are redirected to Redirect
+// (with default_redirect_status by default)
+type IPFilterConfig struct {
+	Allow    []string `yaml:"allow,omitempty"`
+	Deny     []string `yaml:"deny,omitempty"`
+	Status   int      `yaml:"status,omitempty"`
+	Redirect string   `yaml:"redirect,omitempty"`
+
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// load parses the ranges and checks the status of rejected requests,
+// defaultStatus is the one of redirects without status
+func (f *IPFilterConfig) load(defaultStatus int) error {
+	var err error
+	f.allow, err = parseNetworks(f.Allow)
+	if err != nil {
+		return fmt.Errorf("allow: %v", err)
+	}
+
+	f.deny, err = parseNetworks(f.Deny)
+	if err != nil {
+		return fmt.Errorf("deny: %v", err)
+	}
+
+	if f.Redirect == "" {
+		if f.Status == 0 {
+			f.Status = http.StatusForbidden
+		}
+		if f.Status < 400 || f.Status > 599 {
+			return fmt.Errorf("status has to be 4xx or 5xx, got %d", f.Status)
+		}
+	} else {
+		if f.Status == 0 {
+			f.Status = defaultStatus
+		}
+		if f.Status < 300 || f.Status > 399 {
+			return fmt.Errorf("status has to be 3xx with redirect, got %d", f.Status)
+		}
+	}
+
+	return nil
+}
+
+// parseNetworks parses a list of CIDR ranges or single IPs
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		network, err := parseNetwork(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// allowed tells whether requests from ip can pass, deny ranges take
+// precedence, clients without a valid IP only pass without any ranges, so
+// an unparseable X-Forwarded-For can't get past the deny list
+func (f *IPFilterConfig) allowed(ip net.IP) bool {
+	if ip == nil {
+		return len(f.deny) == 0 && len(f.allow) == 0
+	}
+
+	for _, network := range f.deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(f.allow) == 0 {
+		return true
+	}
+
+	for _, network := range f.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withIPFilter rejects requests of clients ip_filter of the current config
+// doesn't let through, the client IP is resolved like for IP conditions
+func withIPFilter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filter := currentConfig().IPFilter
+		if filter == nil || filter.allowed(net.ParseIP(clientIP(r))) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		slog.DebugContext(r.Context(), "Request rejected by ip_filter", "ip", clientIP(r))
+		if filter.Redirect != "" {
+			http.Redirect(w, r, filter.Redirect, filter.Status)
+			return
+		}
+
+		http.Error(w, http.StatusText(filter.Status), filter.Status)
+	})
+}
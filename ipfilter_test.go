@@ -0,0 +1,148 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIPFilter(t *testing.T) {
+	tests := []struct {
+		name       string
+		filter     IPFilterConfig
+		trustProxy bool
+		remoteAddr string
+		forwarded  string
+		allowed    bool
+	}{
+		{
+			name:       "no ranges",
+			remoteAddr: "203.0.113.7:1234",
+			allowed:    true,
+		},
+		{
+			name:       "inside an allow range",
+			filter:     IPFilterConfig{Allow: []string{"10.0.0.0/8"}},
+			remoteAddr: "10.1.2.3:1234",
+			allowed:    true,
+		},
+		{
+			name:       "outside of the allow ranges",
+			filter:     IPFilterConfig{Allow: []string{"10.0.0.0/8", "192.168.1.17"}},
+			remoteAddr: "192.168.1.18:1234",
+		},
+		{
+			name:       "single allowed address",
+			filter:     IPFilterConfig{Allow: []string{"10.0.0.0/8", "192.168.1.17"}},
+			remoteAddr: "192.168.1.17:1234",
+			allowed:    true,
+		},
+		{
+			name:       "inside a deny range",
+			filter:     IPFilterConfig{Deny: []string{"203.0.113.0/24"}},
+			remoteAddr: "203.0.113.7:1234",
+		},
+		{
+			name:       "outside of the deny ranges",
+			filter:     IPFilterConfig{Deny: []string{"203.0.113.0/24"}},
+			remoteAddr: "198.51.100.7:1234",
+			allowed:    true,
+		},
+		{
+			name:       "IPv6 deny range",
+			filter:     IPFilterConfig{Deny: []string{"2001:db8::/32"}},
+			remoteAddr: "[2001:db8::1]:1234",
+		},
+		{
+			name:       "deny takes precedence over allow",
+			filter:     IPFilterConfig{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.13.0.0/16"}},
+			remoteAddr: "10.13.0.1:1234",
+		},
+		{
+			name:       "forwarded address with trust_proxy",
+			filter:     IPFilterConfig{Deny: []string{"203.0.113.0/24"}},
+			trustProxy: true,
+			remoteAddr: "10.0.0.1:1234",
+			forwarded:  "203.0.113.7, 10.0.0.2",
+		},
+		{
+			name:       "forwarded address without trust_proxy",
+			filter:     IPFilterConfig{Deny: []string{"203.0.113.0/24"}},
+			remoteAddr: "10.0.0.1:1234",
+			forwarded:  "203.0.113.7",
+			allowed:    true,
+		},
+		{
+			name:       "unparseable forwarded address with a deny list",
+			filter:     IPFilterConfig{Deny: []string{"203.0.113.0/24"}},
+			trustProxy: true,
+			remoteAddr: "10.0.0.1:1234",
+			forwarded:  "unknown",
+		},
+		{
+			name:       "unparseable forwarded address with an allow list",
+			filter:     IPFilterConfig{Allow: []string{"10.0.0.0/8"}},
+			trustProxy: true,
+			remoteAddr: "10.0.0.1:1234",
+			forwarded:  "unknown",
+		},
+		{
+			name:       "unparseable forwarded address without ranges",
+			trustProxy: true,
+			remoteAddr: "10.0.0.1:1234",
+			forwarded:  "unknown",
+			allowed:    true,
+		},
+	}
+
+	handler := withIPFilter(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter := test.filter
+			err := filter.load(http.StatusFound)
+			if err != nil {
+				t.Fatal(err)
+			}
+			current.Store(&live{config: &Config{IPFilter: &filter, TrustProxy: test.trustProxy}})
+
+			req := httptest.NewRequest("GET", "/go", nil)
+			req.RemoteAddr = test.remoteAddr
+			if test.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", test.forwarded)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			expected := http.StatusForbidden
+			if test.allowed {
+				expected = http.StatusNoContent
+			}
+			if w.Code != expected {
+				t.Fatalf("expected status %d, got %d", expected, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// logLevel is shared by all handlers, so reloads can change it in place
+var logLevel = new(slog.LevelVar)
+
+// logLevels maps log_level names to levels
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// configureLogging sets up the default logger with the level, format and
+// destination of the config, debug: true is a shorthand for log_level: debug
+// The current logger stays in use if log_file can't be opened
+func configureLogging(config *Config) error {
+	err := logOutput.open(config.LogFile)
+	if err != nil {
+		return err
+	}
+
+	level := logLevels[config.LogLevel]
+	if config.LogLevel == "" && config.Debug {
+		level = slog.LevelDebug
+	}
+	logLevel.Set(level)
+
+	options := &slog.HandlerOptions{Level: logLevel}
+	if config.LogFormat == "json" {
+		slog.SetDefault(slog.New(requestHandler{slog.NewJSONHandler(logOutput, options)}))
+	} else {
+		slog.SetDefault(slog.New(requestHandler{slog.NewTextHandler(logOutput, options)}))
+	}
+
+	return nil
+}
+
+// logOutput is where logs and access logs are written, stdout unless log_file
+// is set
+var logOutput = &logFile{}
+
+// logFile writes to a file which can be reopened after logrotate moved it
+// away, or to stdout without a path
+type logFile struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+func (f *logFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return os.Stdout.Write(p)
+	}
+
+	return f.file.Write(p)
+}
+
+// open switches to the file at path, appending to it or creating it, nothing
+// changes if it's already open
+func (f *logFile) open(path string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if path == f.path {
+		return nil
+	}
+
+	return f.swap(path)
+}
+
+// reopen opens the file again, so logs go to a new one after the old one was
+// renamed
+func (f *logFile) reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.swap(f.path)
+}
+
+// swap replaces the open file with the one at path, f.mu has to be held
+func (f *logFile) swap(path string) error {
+	var file *os.File
+	if path != "" {
+		var err error
+		file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	old := f.file
+	f.path, f.file = path, file
+
+	if old != nil {
+		return old.Close()
+	}
+
+	return nil
+}
+
+// requestHandler adds ID of the request to records logged with its context
+type requestHandler struct {
+	slog.Handler
+}
+
+func (h requestHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := requestID(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h requestHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestHandler) WithGroup(name string) slog.Handler {
+	return requestHandler{h.Handler.WithGroup(name)}
+}
+
+// fatal logs an error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
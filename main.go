@@ -21,25 +21,150 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
 	"fmt"
-	"io/ioutil"
+	"hash/fnv"
 	"log"
+	"log/slog"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/julienschmidt/httprouter"
+	"github.com/oschwald/geoip2-golang"
+	"github.com/robfig/cron"
 
 	yaml "gopkg.in/yaml.v2"
 )
 
 // Config defines routes and other stuff
 type Config struct {
-	Routes                 map[string]Route `yaml:"routes"`
-	Address                string           `yaml:"address"`
-	Debug                  bool             `yaml:"debug"`
-	NotFoundRedirect       string           `yaml:"not_found_redirect,omitempty"`
-	NotFoundRedirectStatus int              `yaml:"not_found_redirect_status,omitempty"`
+	Routes                         map[string]Route  `yaml:"routes"`
+	Include                        []string          `yaml:"include,omitempty"`
+	Address                        string            `yaml:"address"`
+	Debug                          bool              `yaml:"debug"`
+	ExampleRoutes                  bool              `yaml:"example_routes,omitempty"`
+	GenerateRequestID              *bool             `yaml:"generate_request_id,omitempty"`
+	CORS                           *CORSConfig       `yaml:"cors,omitempty"`
+	Headers                        map[string]string `yaml:"headers,omitempty"`
+	LogLevel                       string            `yaml:"log_level,omitempty"`
+	LogFormat                      string            `yaml:"log_format,omitempty"`
+	LogFile                        string            `yaml:"log_file,omitempty"`
+	AccessLog                      string            `yaml:"access_log,omitempty"`
+	NotFoundRedirect               string            `yaml:"not_found_redirect,omitempty"`
+	NotFoundRedirectStatus         int               `yaml:"not_found_redirect_status,omitempty"`
+	NotFoundStatus                 int               `yaml:"not_found_status,omitempty"`
+	NotFoundBody                   string            `yaml:"not_found_body,omitempty"`
+	NotFoundFile                   string            `yaml:"not_found_file,omitempty"`
+	NotFoundContentType            string            `yaml:"not_found_content_type,omitempty"`
+	MethodNotAllowedRedirect       string            `yaml:"method_not_allowed_redirect,omitempty"`
+	MethodNotAllowedRedirectStatus int               `yaml:"method_not_allowed_redirect_status,omitempty"`
+	DefaultRedirectStatus          int               `yaml:"default_redirect_status,omitempty"`
+	TrustProxy                     bool              `yaml:"trust_proxy,omitempty"`
+	GeoIPDB                        string            `yaml:"geoip_db,omitempty"`
+	CohortKey                      []string          `yaml:"cohort_key,omitempty"`
+	Buckets                        Buckets           `yaml:"buckets,omitempty"`
+	Bots                           BotConfig         `yaml:"bots,omitempty"`
+	IPFilter                       *IPFilterConfig   `yaml:"ip_filter,omitempty"`
+	BasicAuth                      *BasicAuthConfig  `yaml:"basic_auth,omitempty"`
+	Timezone                       string            `yaml:"timezone,omitempty"`
+	AutoHEAD                       *bool             `yaml:"auto_head,omitempty"`
+	AutoOPTIONS                    *bool             `yaml:"auto_options,omitempty"`
+	MaxBodyBytes                   int64             `yaml:"max_body_bytes,omitempty"`
+	CompressMinBytes               int               `yaml:"compress_min_bytes,omitempty"`
+	UAVelocityWindow               time.Duration     `yaml:"ua_velocity_window,omitempty"`
+	UAVelocityMaxKeys              int               `yaml:"ua_velocity_max_keys,omitempty"`
+	Events                         EventsConfig      `yaml:"events,omitempty"`
+	MaxConnsPerIP                  int               `yaml:"max_conns_per_ip,omitempty"`
+	ConnLimitMode                  string            `yaml:"conn_limit_mode,omitempty"`
+	ConnQueueTimeout               time.Duration     `yaml:"conn_queue_timeout,omitempty"`
+	TLSCert                        string            `yaml:"tls_cert,omitempty"`
+	TLSKey                         string            `yaml:"tls_key,omitempty"`
+	TLSMinVersion                  string            `yaml:"tls_min_version,omitempty"`
+	AutoTLS                        AutoTLSConfig     `yaml:"autotls,omitempty"`
+	RedirectHTTPToHTTPS            bool              `yaml:"redirect_http_to_https,omitempty"`
+	HealthPath                     string            `yaml:"health_path,omitempty"`
+	Metrics                        MetricsConfig     `yaml:"metrics,omitempty"`
+	Admin                          AdminConfig       `yaml:"admin,omitempty"`
+	ReadTimeout                    time.Duration     `yaml:"read_timeout,omitempty"`
+	WriteTimeout                   time.Duration     `yaml:"write_timeout,omitempty"`
+	IdleTimeout                    time.Duration     `yaml:"idle_timeout,omitempty"`
+
+	// location is the loaded timezone, see timeLocation
+	location *time.Location
+
+	// notFound is the response to unmatched requests, if configured
+	notFound *StaticResponse
+
+	// sources maps route paths to the files defining them, see loadConfig
+	sources map[string]string
+}
+
+// timeLocation returns the timezone Time and Cron conditions are evaluated in,
+// the local one of the server unless configured
+func (c *Config) timeLocation() *time.Location {
+	if c.location == nil {
+		return time.Local
+	}
+
+	return c.location
+}
+
+// Buckets defines named, weighted buckets requests are assigned to for Bucket
+// conditions
+// With the random (default) assignment every request is drawn independently,
+// with hash the bucket is derived from the same attributes as Cohort
+// (cohort_key), so a client keeps its bucket as long as the key sources and
+// weights stay the same
+type Buckets struct {
+	Assignment string         `yaml:"assignment,omitempty"`
+	Weights    map[string]int `yaml:"weights"`
+}
+
+// Assign picks a bucket for the request, it returns an empty string when no
+// buckets are defined
+func (b Buckets) Assign(req *http.Request) string {
+	names := make([]string, 0, len(b.Weights))
+	total := 0
+	for name, weight := range b.Weights {
+		names = append(names, name)
+		total += weight
+	}
+	if total <= 0 {
+		return ""
+	}
+
+	// Sorting keeps the hash assignment stable between runs
+	sort.Strings(names)
+
+	var point int
+	if b.Assignment == "hash" {
+		point = int(cohortHash(req) % uint32(total))
+	} else {
+		point = rand.Intn(total)
+	}
+
+	for _, name := range names {
+		point -= b.Weights[name]
+		if point < 0 {
+			return name
+		}
+	}
+
+	return ""
 }
 
 // CompareFunc enforces structure of underlaying comparing functions
@@ -52,62 +177,595 @@ type CompareFunc func(a, b string) bool
 type Condition struct {
 	Raw         string
 	Type        string      `yaml:"-"`
+	Operator    string      `yaml:"-"`
 	Expected    string      `yaml:"-"`
 	CompareFunc CompareFunc `yaml:"-"`
+
+	// Key is the name of the header, cookie, query parameter or GeoIP field for
+	// conditions declared as Header:<name>, Cookie:<name>, Query:<key> and Geo:<field>
+	Key string `yaml:"-"`
+
+	// Label names the result of a condition declared with a trailing "as <label>"
+	Label string `yaml:"-"`
+
+	// ShortCircuitTarget makes a passing condition redirect there right away,
+	// skipping all the conditions below it, a failing one is simply ignored
+	ShortCircuitTarget string `yaml:"-"`
+
+	// FailureRedirect overrides the route's one when this condition fails it
+	FailureRedirect string `yaml:"-"`
+
+	// Values is the parsed comma-separated expected value of an in operator
+	Values []string `yaml:"-"`
+
+	// Regexp is the compiled expected value of a matches operator
+	Regexp *regexp.Regexp `yaml:"-"`
+
+	// Network is the parsed range of an IP condition
+	Network *net.IPNet `yaml:"-"`
+
+	// Schedule and Window describe recurring active windows of a Cron condition
+	Schedule cron.Schedule `yaml:"-"`
+	Window   time.Duration `yaml:"-"`
+
+	// ExpectedTime and ExpectedNumber hold the expected value of Time and
+	// numeric conditions, parsed once instead of on every request
+	ExpectedTime   time.Time `yaml:"-"`
+	ExpectedNumber int       `yaml:"-"`
+
+	// TimeCompareFunc checks the current time against ExpectedTime for Time
+	// lt and gt conditions, without formatting and parsing it again
+	TimeCompareFunc func(t time.Time) bool `yaml:"-"`
+
+	// DailyWindow holds start and end of a Time within window as offsets from
+	// midnight
+	DailyWindow [2]time.Duration `yaml:"-"`
+
+	// Presence makes the condition check whether its key is present at all
+	// instead of its value, which is then "true" or "false"
+	Presence bool `yaml:"-"`
 }
 
 // UnmarshalYAML makes condition implement yaml.Marshaller to work properly
+// Conditions are either plain strings or mappings with the condition string
+// under the condition key and its options next to it
 func (c *Condition) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	raw := ""
 	err := unmarshal(&raw)
+	if err == nil {
+		c.Raw = raw
+		return nil
+	}
+
+	options := struct {
+		Condition          string `yaml:"condition"`
+		ShortCircuitTarget string `yaml:"short_circuit_target"`
+		FailureRedirect    string `yaml:"failure_redirect"`
+	}{}
+	err = unmarshal(&options)
 	if err != nil {
 		return err
 	}
 
-	c.Raw = raw
+	c.Raw = options.Condition
+	c.ShortCircuitTarget = options.ShortCircuitTarget
+	c.FailureRedirect = options.FailureRedirect
 	return nil
 }
 
-// Parse populates the condition
-func (c *Condition) Parse() {
-	expr := strings.Split(c.Raw, " ")
+// Parse populates the condition, it returns an error if the condition is
+// improperly configured
+func (c *Condition) Parse() error {
+	expr, err := tokenize(c.Raw)
+	if err != nil {
+		return err
+	}
+
+	// Presence operators (exists, absent) come without an expected value
+	presence := len(expr) > 1 && (expr[1] == "exists" || expr[1] == "absent")
+	required := 3
+	if presence {
+		required = 2
+	}
+
+	// Labelled conditions end with "as <label>"
+	if len(expr) > required+1 && expr[len(expr)-2] == "as" {
+		c.Label = expr[len(expr)-1]
+		expr = expr[:len(expr)-2]
+	}
+
+	if presence && len(expr) > 2 {
+		return fmt.Errorf("operator %q takes no expected value", expr[1])
+	}
+
+	if len(expr) < required {
+		return fmt.Errorf("expected <subject> <operator> <expected value>, got %d token(s)", len(expr))
+	}
+
+	// Everything after the operator makes up the expected value
 	value := expr[0]
 	operator := expr[1]
-	expected := expr[2]
+	expected := strings.Join(expr[2:], " ")
+
+	c.Operator = operator
 
 	var compareFunc CompareFunc
 
+	// Subjects with a key are declared as <subject>:<key>
+	for _, keyed := range []string{"User-Agent", "Header", "Cookie", "Query", "Geo", "Random"} {
+		if strings.HasPrefix(value, keyed+":") {
+			c.Key = strings.TrimPrefix(value, keyed+":")
+			value = keyed
+		}
+	}
+
+	// User-Agent:bot tells whether the request comes from a crawler or a tool
+	if value == "User-Agent" && c.Key != "" {
+		if c.Key != "bot" {
+			return fmt.Errorf("unknown User-Agent key %q", c.Key)
+		}
+		if operator != "is" || (expected != "true" && expected != "false") {
+			return fmt.Errorf("expected User-Agent:bot is true or User-Agent:bot is false")
+		}
+
+		c.Expected, c.Type, c.CompareFunc = expected, value, c.isEqual
+		return nil
+	}
+
 	switch value {
-	case "User-Agent":
-		switch operator {
-		case "has":
-			compareFunc = c.contains
-		case "is":
+	case "User-Agent", "Header", "Cookie", "Query", "Path", "Scheme", "Proto":
+		if (value == "Header" || value == "Cookie" || value == "Query") && c.Key == "" {
+			return fmt.Errorf("%s needs a key, e.g. %s:<name>", value, value)
+		}
+
+		if presence {
+			if value != "Header" && value != "Cookie" && value != "Query" {
+				return fmt.Errorf("operator %q only works with Header, Cookie and Query", operator)
+			}
+
+			// Compared with whether the key is present, see Evaluate
+			c.Presence = true
+			expected = strconv.FormatBool(operator == "exists")
 			compareFunc = c.isEqual
-		case "starts_with":
-			compareFunc = c.hasPrefix
-		case "ends_with":
-			compareFunc = c.hasSuffix
-		default:
-			log.Println("Improperly configured condition:", c.Raw)
+			break
+		}
+
+		compareFunc, err = c.stringCompareFunc(operator, expected)
+		if err != nil {
+			return err
 		}
 
 	case "Time":
+		// Expected value is either an RFC3339 timestamp, a duration relative to
+		// loading the config (e.g. +2h or -30m) or, for within, a daily window
+		// in form of HH:MM-HH:MM
+		switch operator {
+		case "lt", "before", "gt", "after":
+			if strings.HasPrefix(expected, "+") || strings.HasPrefix(expected, "-") {
+				offset, err := time.ParseDuration(expected)
+				if err != nil {
+					return err
+				}
+
+				expected = time.Now().Add(offset).Format(time.RFC3339)
+			}
+
+			c.ExpectedTime, err = time.Parse(time.RFC3339, expected)
+			if err != nil {
+				return err
+			}
+
+			if operator == "lt" || operator == "before" {
+				compareFunc, c.TimeCompareFunc = c.timeBefore, c.before
+			} else {
+				compareFunc, c.TimeCompareFunc = c.timeAfter, c.after
+			}
+		case "within":
+			c.DailyWindow, err = parseDailyWindow(expected)
+			if err != nil {
+				return err
+			}
+
+			compareFunc = c.timeWithin
+		default:
+			return fmt.Errorf("unknown operator %q", operator)
+		}
+
+	case "TLSVersion":
+		expected = normalizeTLSVersion(expected)
+
 		switch operator {
 		case "lt":
-			compareFunc = c.timeBefore
+			compareFunc = c.tlsVersionLess
 		case "gt":
-			compareFunc = c.timeAfter
+			compareFunc = c.tlsVersionGreater
+		case "is":
+			compareFunc = c.isEqual
+		default:
+			return fmt.Errorf("unknown operator %q", operator)
+		}
+
+	case "TLSCipher":
+		// Numeric cipher suite IDs (e.g. 0xc02f) are compared by their names
+		if id, err := strconv.ParseUint(expected, 0, 16); err == nil {
+			expected = tls.CipherSuiteName(uint16(id))
+		}
+
+		compareFunc, err = c.stringCompareFunc(operator, expected)
+		if err != nil {
+			return err
+		}
+
+	case "Geo":
+		if c.Key != "country" {
+			return fmt.Errorf("unknown Geo field %q", c.Key)
+		}
+
+		compareFunc, err = c.stringCompareFunc(operator, expected)
+		if err != nil {
+			return err
+		}
+
+	case "IP":
+		switch operator {
+		case "in":
+			network, err := parseNetwork(expected)
+			if err != nil {
+				return err
+			}
+
+			c.Network = network
+			compareFunc = c.ipIn
+		default:
+			return fmt.Errorf("unknown operator %q", operator)
+		}
+
+	case "Labels":
+		switch operator {
+		case "match":
+			compareFunc = c.labelsMatch
+		default:
+			return fmt.Errorf("unknown operator %q", operator)
+		}
+
+	case "UAVelocity":
+		switch operator {
+		case "lt", "gt":
+			c.ExpectedNumber, err = strconv.Atoi(expected)
+			if err != nil {
+				return fmt.Errorf("operator %q expects a whole number, got %q", operator, expected)
+			}
+
+			if operator == "lt" {
+				compareFunc = c.numberLess
+			} else {
+				compareFunc = c.numberGreater
+			}
+		default:
+			return fmt.Errorf("unknown operator %q", operator)
+		}
+
+	case "Bucket":
+		switch operator {
+		case "is":
+			compareFunc = c.isEqual
+		default:
+			return fmt.Errorf("unknown operator %q", operator)
+		}
+
+	case "Random":
+		// Random numbers are either drawn for every request or derived from
+		// the client IP (Random:ip) or a cookie (Random:cookie:<name>)
+		if c.Key != "" && c.Key != "ip" && (!strings.HasPrefix(c.Key, "cookie:") || c.Key == "cookie:") {
+			return fmt.Errorf("unknown Random key %q", c.Key)
+		}
+
+		fallthrough
+
+	case "Cohort":
+		switch operator {
+		case "lt", "gt":
+			c.ExpectedNumber, err = strconv.Atoi(expected)
+			if err != nil {
+				return fmt.Errorf("operator %q expects a whole number, got %q", operator, expected)
+			}
+
+			if operator == "lt" {
+				compareFunc = c.numberLess
+			} else {
+				compareFunc = c.numberGreater
+			}
+		case "is":
+			compareFunc = c.isEqual
+		default:
+			return fmt.Errorf("unknown operator %q", operator)
+		}
+
+	case "Cron":
+		// Expected value is in form of:
+		// <duration> <minute> <hour> <day of month> <month> <day of week>
+		switch operator {
+		case "within":
+			fields := strings.SplitN(expected, " ", 2)
+			if len(fields) != 2 {
+				return fmt.Errorf("expected a window duration followed by a cron expression")
+			}
+
+			window, err := time.ParseDuration(fields[0])
+			if err != nil {
+				return fmt.Errorf("invalid window: %v", err)
+			}
+			if window <= 0 {
+				return fmt.Errorf("window has to be positive, got %s", fields[0])
+			}
+
+			schedule, err := cron.ParseStandard(fields[1])
+			if err != nil {
+				return fmt.Errorf("invalid cron expression: %v", err)
+			}
+
+			c.Window = window
+			c.Schedule = schedule
+			compareFunc = c.cronWithin
 		default:
-			log.Println("Improperly configured condition:", c.Raw)
+			return fmt.Errorf("unknown operator %q", operator)
 		}
 	default:
-		log.Println("Improperly configured condition:", c.Raw)
+		return fmt.Errorf("unknown subject %q", value)
 	}
 
 	c.Expected = expected
 	c.Type = value
 	c.CompareFunc = compareFunc
+	return nil
+}
+
+// tokenize splits a raw condition on spaces, double quoted parts are kept
+// together with quotes removed, so "" is an empty token and "a b" a single one
+// Quotes inside of quoted parts can be escaped with a backslash
+func tokenize(raw string) ([]string, error) {
+	tokens := []string{}
+
+	var token strings.Builder
+	inToken, quoted, escaped := false, false, false
+	for _, r := range raw {
+		switch {
+		case escaped:
+			token.WriteRune(r)
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+			inToken = true
+		case r == ' ' && !quoted:
+			if inToken {
+				tokens = append(tokens, token.String())
+				token.Reset()
+				inToken = false
+			}
+		default:
+			token.WriteRune(r)
+			inToken = true
+		}
+	}
+
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+
+	if inToken {
+		tokens = append(tokens, token.String())
+	}
+
+	return tokens, nil
+}
+
+// Evaluate extracts the value of the condition's subject from the request and
+// checks it against the expected one, results of labelled conditions are
+// recorded for Labels conditions evaluated later for the same request
+// Conditions of unknown subjects always pass
+func (c *Condition) Evaluate(req *http.Request) bool {
+	state := stateOf(req)
+
+	var actual string
+	var now time.Time
+
+	switch c.Type {
+	case "User-Agent":
+		actual = req.Header.Get("User-Agent")
+		if c.Key == "bot" {
+			actual = strconv.FormatBool(currentConfig().Bots.isBot(actual))
+		}
+	case "Path":
+		actual = req.URL.Path
+	case "Scheme":
+		actual = requestScheme(req)
+	case "Proto":
+		actual = req.Proto
+	case "Header":
+		actual = req.Header.Get(c.Key)
+	case "Cookie":
+		actual = cookieValue(req, c.Key)
+	case "Query":
+		// Only the first value counts when the key is repeated
+		actual = req.URL.Query().Get(c.Key)
+	case "Time", "Cron":
+		now = time.Now().In(currentConfig().timeLocation())
+		actual = now.Format(time.RFC3339)
+	case "IP":
+		actual = clientIP(req)
+	case "Geo":
+		actual = geoCountry(req)
+	case "Cohort":
+		actual = strconv.Itoa(cohortBucket(req))
+	case "Random":
+		actual = strconv.Itoa(randomPercent(req, c.Key))
+	case "UAVelocity":
+		actual = strconv.Itoa(state.velocity)
+	case "Bucket":
+		if !state.assigned {
+			state.bucket, state.assigned = currentConfig().Buckets.Assign(req), true
+		}
+		actual = state.bucket
+	case "TLSVersion":
+		actual, _ = tlsState(req)
+	case "TLSCipher":
+		_, actual = tlsState(req)
+	case "Labels":
+		actual = strings.Join(state.matched, ",")
+	default:
+		return true
+	}
+
+	if c.Presence {
+		actual = strconv.FormatBool(c.present(req))
+	}
+
+	var passed bool
+	if c.TimeCompareFunc != nil {
+		passed = c.TimeCompareFunc(now)
+	} else {
+		passed = c.CompareFunc(actual, c.Expected)
+	}
+	slog.DebugContext(req.Context(), "Checked condition", "route", state.route, "subject", c.Type, "expected", c.Expected, "actual", actual, "result", passed)
+	if state.tracing {
+		state.trace = append(state.trace, ConditionTrace{Condition: c.Raw, Subject: c.Type, Expected: c.Expected, Actual: actual, Passed: passed})
+	}
+
+	if passed && c.Label != "" {
+		state.matched = append(state.matched, c.Label)
+	}
+
+	// Groups of the last passed matches condition can be used in the success target
+	if passed && c.Regexp != nil {
+		if submatches := c.Regexp.FindStringSubmatch(actual); submatches != nil {
+			state.submatches = submatches
+		}
+	}
+
+	return passed
+}
+
+// stringCompareFunc returns the CompareFunc of a string operator, the expected
+// value of matches is compiled once here
+// Operators prefixed with not_ invert the result of the base operator, as
+// missing values are compared as empty strings, e.g. a missing header passes
+// "not_has x" and fails "has x"
+// Operators suffixed with _i compare case-insensitively, e.g. has_i or not_is_i
+func (c *Condition) stringCompareFunc(operator, expected string) (CompareFunc, error) {
+	if strings.HasPrefix(operator, "not_") {
+		compareFunc, err := c.stringCompareFunc(strings.TrimPrefix(operator, "not_"), expected)
+		if err != nil {
+			return nil, err
+		}
+
+		return func(a, b string) bool {
+			return !compareFunc(a, b)
+		}, nil
+	}
+
+	if strings.HasSuffix(operator, "_i") {
+		operator = strings.TrimSuffix(operator, "_i")
+		if operator == "matches" {
+			return c.stringCompareFunc(operator, "(?i)"+expected)
+		}
+
+		compareFunc, err := c.stringCompareFunc(operator, strings.ToLower(expected))
+		if err != nil {
+			return nil, err
+		}
+
+		return func(a, b string) bool {
+			return compareFunc(strings.ToLower(a), strings.ToLower(b))
+		}, nil
+	}
+
+	// Alternatives separated with | pass if any of them does
+	if alternativeCompares[operator] != nil && strings.Contains(expected, "|") {
+		alternatives := strings.Split(expected, "|")
+		for _, alternative := range alternatives {
+			if alternative == "" {
+				return nil, fmt.Errorf("operator %q got an empty alternative in %q", operator, expected)
+			}
+		}
+
+		compare := alternativeCompares[operator]
+		return func(a, _ string) bool {
+			for _, alternative := range alternatives {
+				if compare(a, alternative) {
+					return true
+				}
+			}
+
+			return false
+		}, nil
+	}
+
+	switch operator {
+	case "has":
+		return c.contains, nil
+	case "is":
+		return c.isEqual, nil
+	case "starts_with":
+		return c.hasPrefix, nil
+	case "ends_with":
+		return c.hasSuffix, nil
+	case "in":
+		c.Values = []string{}
+		for _, value := range strings.Split(expected, ",") {
+			c.Values = append(c.Values, strings.TrimSpace(value))
+		}
+
+		return c.isOneOf, nil
+	case "matches":
+		re, err := regexp.Compile(expected)
+		if err != nil {
+			return nil, err
+		}
+
+		c.Regexp = re
+		return c.matches, nil
+	case "lt", "lte", "gt", "gte", "eq":
+		return numberCompareFunc(operator, expected)
+	}
+
+	return nil, fmt.Errorf("unknown operator %q", operator)
+}
+
+// alternativeCompares are string operators accepting alternatives
+var alternativeCompares = map[string]func(s, substr string) bool{
+	"has":         strings.Contains,
+	"starts_with": strings.HasPrefix,
+	"ends_with":   strings.HasSuffix,
+}
+
+// numberCompares are comparisons of numeric operators of string subjects
+var numberCompares = map[string]func(a, b float64) bool{
+	"lt":  func(a, b float64) bool { return a < b },
+	"lte": func(a, b float64) bool { return a <= b },
+	"gt":  func(a, b float64) bool { return a > b },
+	"gte": func(a, b float64) bool { return a >= b },
+	"eq":  func(a, b float64) bool { return a == b },
+}
+
+// numberCompareFunc returns a CompareFunc comparing values as numbers, values
+// which aren't numbers never pass
+func numberCompareFunc(operator, expected string) (CompareFunc, error) {
+	number, err := strconv.ParseFloat(expected, 64)
+	if err != nil {
+		return nil, fmt.Errorf("operator %q expects a number, got %q", operator, expected)
+	}
+
+	compare := numberCompares[operator]
+	return func(a, b string) bool {
+		n, err := strconv.ParseFloat(strings.TrimSpace(a), 64)
+		if err != nil {
+			return false
+		}
+
+		return compare(n, number)
+	}, nil
 }
 
 // This wrapping of strings.* functions is necessary or pointers get lost
@@ -127,151 +785,1197 @@ func (c Condition) hasSuffix(a, b string) bool {
 	return strings.HasSuffix(a, b)
 }
 
+func (c Condition) isOneOf(a, b string) bool {
+	for _, value := range c.Values {
+		if a == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c Condition) matches(a, b string) bool {
+	return c.Regexp.MatchString(a)
+}
+
+// timeBefore and timeAfter compare a with the expected time parsed once by Parse
 func (c Condition) timeBefore(a, b string) bool {
-	t1, err := time.Parse(time.RFC3339, a)
+	t, err := time.Parse(time.RFC3339, a)
 	if err != nil {
-		log.Println("T1 parsing error:", err)
+		slog.Warn("Cannot parse time", "error", err)
 		return false
 	}
 
-	t2, err := time.Parse(time.RFC3339, b)
+	return c.before(t)
+}
+
+func (c Condition) timeAfter(a, b string) bool {
+	t, err := time.Parse(time.RFC3339, a)
 	if err != nil {
-		log.Println("T2 parsing error:", err)
+		slog.Warn("Cannot parse time", "error", err)
 		return false
 	}
 
-	if t1.Before(t2) {
-		return true
-	}
+	return c.after(t)
+}
 
-	return false
+// before and after compare t with the expected time
+func (c Condition) before(t time.Time) bool {
+	return t.Before(c.ExpectedTime)
 }
 
-func (c Condition) timeAfter(a, b string) bool {
-	t1, err := time.Parse(time.RFC3339, a)
+func (c Condition) after(t time.Time) bool {
+	return c.ExpectedTime.Before(t)
+}
+
+// numberLess and numberGreater compare a with the expected number parsed once
+// by Parse
+func (c Condition) numberLess(a, b string) bool {
+	n, err := strconv.Atoi(a)
 	if err != nil {
-		log.Println("T1 parsing error:", err)
+		slog.Warn("Cannot parse number", "error", err)
 		return false
 	}
 
-	t2, err := time.Parse(time.RFC3339, b)
+	return n < c.ExpectedNumber
+}
+
+func (c Condition) numberGreater(a, b string) bool {
+	n, err := strconv.Atoi(a)
 	if err != nil {
-		log.Println("T2 parsing error:", err)
+		slog.Warn("Cannot parse number", "error", err)
 		return false
 	}
 
-	if t2.Before(t1) {
-		return true
+	return n > c.ExpectedNumber
+}
+
+// ipIn checks whether a is an IP within the pre-parsed network
+func (c Condition) ipIn(a, b string) bool {
+	ip := net.ParseIP(a)
+	if ip == nil {
+		return false
 	}
 
-	return false
+	return c.Network.Contains(ip)
 }
 
-// Route is the main structure of the application containing information about
-// one route with conditions, methods and success/failure redirects
-// It should be Unmarshalled from YAML
-type Route struct {
-	Path            string       `yaml:"path"`
-	Conditions      []*Condition `yaml:"conditions"`
-	AllowedMethods  []string     `yaml:"allowed_methods"`
-	SuccessRedirect string       `yaml:"success_redirect"`
-	FailureRedirect string       `yaml:"failure_redirect"`
-	RedirectStatus  int          `yaml:"redirect_status"`
+// tlsVersions maps TLS version names used in conditions to their protocol values
+// Requests which weren't received over TLS by toasted itself (including TLS
+// terminated by a proxy in front of it) have the version and cipher of "none"
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
 }
 
-// ParseConditions parses all the defined raw conditions in a route
-func (r *Route) ParseConditions() {
-	for _, condition := range r.Conditions {
-		condition.Parse()
+// normalizeTLSVersion turns numeric TLS versions (e.g. 0x0303 or 771) into names
+func normalizeTLSVersion(version string) string {
+	id, err := strconv.ParseUint(version, 0, 16)
+	if err != nil {
+		return version
+	}
+
+	for name, value := range tlsVersions {
+		if value == uint16(id) {
+			return name
+		}
 	}
+
+	return version
 }
 
-// BuildHandler creates httprouter.Handle function to do the routing with
-// the data specified on the route
-func (r Route) BuildHandler() httprouter.Handle {
-	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
-		for _, condition := range r.Conditions {
-			switch condition.Type {
-			case "User-Agent":
-				if config.Debug {
-					log.Println("Checking", condition.Type, ", Got:", req.Header.Get("User-Agent"), "Expected:", condition.Expected)
-					log.Println("Evaluates to:", condition.CompareFunc(req.Header.Get("User-Agent"), condition.Expected))
-				}
+// tlsState returns names of the TLS version and cipher suite of a request
+func tlsState(req *http.Request) (string, string) {
+	if req.TLS == nil {
+		return "none", "none"
+	}
 
-				if !condition.CompareFunc(req.Header.Get("User-Agent"), condition.Expected) {
-					http.Redirect(w, req, r.FailureRedirect, r.RedirectStatus)
-					return
-				}
+	return normalizeTLSVersion(strconv.Itoa(int(req.TLS.Version))), tls.CipherSuiteName(req.TLS.CipherSuite)
+}
 
-			case "Time":
-				if config.Debug {
-					log.Println("Time condition evaluates to:", condition.CompareFunc(time.Now().Format(time.RFC3339), condition.Expected))
-				}
-				if !condition.CompareFunc(time.Now().Format(time.RFC3339), condition.Expected) {
-					http.Redirect(w, req, r.FailureRedirect, r.RedirectStatus)
-					return
-				}
+func (c Condition) tlsVersionLess(a, b string) bool {
+	v1, ok1 := tlsVersions[a]
+	v2, ok2 := tlsVersions[b]
+	return ok1 && ok2 && v1 < v2
+}
+
+func (c Condition) tlsVersionGreater(a, b string) bool {
+	v1, ok1 := tlsVersions[a]
+	v2, ok2 := tlsVersions[b]
+	return ok1 && ok2 && v1 > v2
+}
+
+// labelsMatch evaluates b, a boolean expression over labels, treating labels listed
+// in a as true and all other as false
+// Expression consists of labels, optionally negated with !, joined with & (and)
+// which binds tighter than | (or), e.g. mobile&!tablet|bot
+func (c Condition) labelsMatch(a, b string) bool {
+	matched := map[string]bool{}
+	for _, label := range strings.Split(a, ",") {
+		matched[label] = true
+	}
+
+	for _, alternative := range strings.Split(b, "|") {
+		passed := true
+		for _, term := range strings.Split(alternative, "&") {
+			negated := strings.HasPrefix(term, "!")
+			if negated == matched[strings.TrimPrefix(term, "!")] {
+				passed = false
+				break
 			}
 		}
 
-		// If all the checks have passed and not returned it's safe to redirect
-		http.Redirect(w, req, r.SuccessRedirect, r.RedirectStatus)
-		return
+		if passed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// expressionLabels lists all labels used in a Labels expression
+func expressionLabels(expr string) []string {
+	labels := []string{}
+	for _, alternative := range strings.Split(expr, "|") {
+		for _, term := range strings.Split(alternative, "&") {
+			labels = append(labels, strings.TrimPrefix(term, "!"))
+		}
+	}
+
+	return labels
+}
+
+// parseNetwork parses a CIDR range, single addresses are treated as ranges
+// containing only them
+func parseNetwork(cidr string) (*net.IPNet, error) {
+	if !strings.Contains(cidr, "/") {
+		if strings.Contains(cidr, ":") {
+			cidr += "/128"
+		} else {
+			cidr += "/32"
+		}
 	}
+
+	_, network, err := net.ParseCIDR(cidr)
+	return network, err
 }
 
-var config Config
+// parseDailyWindow parses a HH:MM-HH:MM window into offsets from midnight
+func parseDailyWindow(window string) ([2]time.Duration, error) {
+	offsets := [2]time.Duration{}
+
+	bounds := strings.Split(window, "-")
+	if len(bounds) != 2 {
+		return offsets, fmt.Errorf("expected a window in form of HH:MM-HH:MM, got %q", window)
+	}
+
+	for i, bound := range bounds {
+		clock, err := time.Parse("15:04", strings.TrimSpace(bound))
+		if err != nil {
+			return offsets, fmt.Errorf("expected a window in form of HH:MM-HH:MM, got %q", window)
+		}
+
+		offsets[i] = time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute
+	}
 
-func init() {
-	file, err := ioutil.ReadFile("./config.yaml")
+	return offsets, nil
+}
+
+// timeWithin checks whether the time of day of a falls into the pre-parsed daily
+// window, including its start and excluding its end
+// Windows ending before they start span midnight, e.g. 22:00-06:00
+func (c Condition) timeWithin(a, b string) bool {
+	t, err := time.Parse(time.RFC3339, a)
 	if err != nil {
-		log.Panicln("Cannot find config.yaml:", err)
+		slog.Warn("Cannot parse time", "error", err)
+		return false
 	}
 
-	config = Config{}
-	err = yaml.Unmarshal(file, &config)
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	start, end := c.DailyWindow[0], c.DailyWindow[1]
+	if start <= end {
+		return offset >= start && offset < end
+	}
+
+	return offset >= start || offset < end
+}
+
+// cronWithin checks whether a falls into any window starting at a cron activation
+// and lasting for the configured duration, the expected value is pre-parsed
+func (c Condition) cronWithin(a, b string) bool {
+	t, err := time.Parse(time.RFC3339, a)
 	if err != nil {
-		log.Panicln("Failed loading config:", err)
+		slog.Warn("Cannot parse time", "error", err)
+		return false
+	}
+
+	// Cron expressions are in the configured timezone, with its DST changes
+	// rather than the fixed offset of a
+	t = t.In(currentConfig().timeLocation())
+
+	// First activation after the earliest possible window start has to have
+	// already happened for t to be inside of its window
+	start := c.Schedule.Next(t.Add(-c.Window))
+	if start.IsZero() || start.After(t) {
+		return false
 	}
 
-	fmt.Println("Loaded routes: ")
-	for route, conf := range config.Routes {
-		fmt.Println(route, "-->", conf.SuccessRedirect, "||", "x", "-->", conf.FailureRedirect)
-		fmt.Println(" ", strings.Join(conf.AllowedMethods, ", "))
-		for _, cond := range conf.Conditions {
-			fmt.Println("   ", cond.Raw)
+	return true
+}
+
+// clientIP returns the address of the client without port
+// With trust_proxy on, the left-most X-Forwarded-For entry is used if present,
+// otherwise the header is ignored as any client could set it
+func clientIP(req *http.Request) string {
+	if currentConfig().TrustProxy {
+		forwarded := strings.TrimSpace(strings.Split(req.Header.Get("X-Forwarded-For"), ",")[0])
+		if forwarded != "" {
+			return forwarded
 		}
-		fmt.Println()
 	}
 
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
 }
 
-func main() {
-	router := httprouter.New()
+// requestScheme returns the scheme the client used, http or https
+// With trust_proxy on, X-Forwarded-Proto is used if present
+func requestScheme(req *http.Request) string {
+	if currentConfig().TrustProxy {
+		forwarded := strings.TrimSpace(strings.Split(req.Header.Get("X-Forwarded-Proto"), ",")[0])
+		if forwarded != "" {
+			return strings.ToLower(forwarded)
+		}
+	}
 
-	if config.NotFoundRedirect != "" && config.NotFoundRedirectStatus != 0 {
-		fmt.Println("Not found redirect is ON. Redirecting to", config.NotFoundRedirect, "with status", config.NotFoundRedirectStatus)
-		router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			http.Redirect(w, r, config.NotFoundRedirect, config.NotFoundRedirectStatus)
-		})
-	} else {
-		fmt.Println("Not found redirect is OFF. Returning 404s.")
+	if req.TLS != nil {
+		return "https"
+	}
+
+	return "http"
+}
+
+// geoCountry returns ISO code of the country the client IP is located in, or an
+// empty string if it can't be resolved
+func geoCountry(req *http.Request) string {
+	ip := net.ParseIP(clientIP(req))
+	if ip == nil {
+		return ""
+	}
+
+	record, err := geoip.Country(ip)
+	if err != nil {
+		slog.WarnContext(req.Context(), "GeoIP lookup failed", "ip", ip, "error", err)
+		return ""
+	}
+
+	return record.Country.IsoCode
+}
+
+// randomPercent returns a number from 0 to 99, drawn at random or, with a key,
+// hashed from the client IP or a cookie, so the same client always gets the same
+// number. Requests without the cookie get a random one
+func randomPercent(req *http.Request, key string) int {
+	value := ""
+	if key == "ip" {
+		value = clientIP(req)
+	} else if strings.HasPrefix(key, "cookie:") {
+		if cookie, err := req.Cookie(strings.TrimPrefix(key, "cookie:")); err == nil {
+			value = cookie.Value
+		}
+	}
+
+	if value == "" {
+		return rand.Intn(100)
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(value))
+	return int(h.Sum32() % 100)
+}
+
+// cohortKeySources lists request attributes which can make up a cohort key
+var cohortKeySources = map[string]bool{"ip": true, "user_agent": true}
+
+// cohortHash hashes request attributes listed in config.CohortKey (ip and
+// user_agent by default) with 32-bit FNV-1a
+func cohortHash(req *http.Request) uint32 {
+	sources := currentConfig().CohortKey
+	if len(sources) == 0 {
+		sources = []string{"ip", "user_agent"}
+	}
+
+	h := fnv.New32a()
+	for _, source := range sources {
+		switch source {
+		case "ip":
+			h.Write([]byte(clientIP(req)))
+		case "user_agent":
+			h.Write([]byte(req.Header.Get("User-Agent")))
+		}
+		// Separator keeps "ab"+"c" and "a"+"bc" from hashing to the same value
+		h.Write([]byte{0})
+	}
+
+	return h.Sum32()
+}
+
+// cohortBucket deterministically assigns a request to a bucket from 0 to 99
+//
+// As long as the key sources don't change, the same client always lands in the
+// same bucket and buckets are nested, so everyone in "Cohort lt 5" stays in the
+// cohort when it's widened to "Cohort lt 10". Buckets are close to uniform for
+// a large number of distinct keys, but clients sharing all key attributes
+// (e.g. behind one NAT with the same browser) always share a bucket.
+func cohortBucket(req *http.Request) int {
+	return int(cohortHash(req) % 100)
+}
+
+// Route is the main structure of the application containing information about
+// one route with conditions, methods and success/failure redirects
+// It should be Unmarshalled from YAML
+type Route struct {
+	Path            string       `yaml:"path"`
+	Enabled         *bool        `yaml:"enabled,omitempty"`
+	Conditions      []*Condition `yaml:"conditions"`
+	AllowedMethods  []string     `yaml:"allowed_methods"`
+	SuccessRedirect string       `yaml:"success_redirect"`
+	FailureRedirect string       `yaml:"failure_redirect"`
+	RedirectStatus  int          `yaml:"redirect_status"`
+
+	// Match decides whether all (default) or any of the conditions and groups
+	// have to pass
+	Match  string   `yaml:"match,omitempty"`
+	Groups []*Group `yaml:"groups,omitempty"`
+
+	// Invert swaps success and failure after the conditions and groups are
+	// combined, short-circuit conditions still redirect right away and failure
+	// redirects of conditions are ignored, as a failing one leads to success
+	Invert bool `yaml:"invert,omitempty"`
+
+	// AcceptRedirects maps media types to success targets picked by the Accept
+	// header, SuccessRedirect is used when none of them is acceptable
+	AcceptRedirects map[string]string `yaml:"accept_redirects,omitempty"`
+
+	// PreserveQuery appends query of the request to the redirect target
+	PreserveQuery bool `yaml:"preserve_query,omitempty"`
+
+	// AppendPath appends the rest of the request path to the redirect target
+	// The rest is what's left after StripPrefix if it's set, otherwise value of
+	// the catch-all parameter if the path ends with one (e.g. /docs/*rest) or
+	// the whole request path
+	AppendPath  bool   `yaml:"append_path,omitempty"`
+	StripPrefix string `yaml:"strip_prefix,omitempty"`
+
+	// Respond is written instead of the success redirect
+	Respond *StaticResponse `yaml:"respond,omitempty"`
+
+	// Targets are success targets picked by the strategy, weighted by default
+	Targets  []Target `yaml:"targets,omitempty"`
+	Strategy string   `yaml:"strategy,omitempty"`
+
+	// Sticky sends repeat visitors to the same one of the targets
+	Sticky *StickyConfig `yaml:"sticky,omitempty"`
+
+	// cumulative holds running sums of weights of the targets
+	cumulative []int
+
+	// CORS lets browsers on other origins fetch the route, the global cors
+	// config is used for routes without their own
+	CORS *CORSConfig `yaml:"cors,omitempty"`
+
+	// RateLimit limits requests per client IP, requests over it get 429s
+	RateLimit *RateLimitConfig `yaml:"rate_limit,omitempty"`
+
+	// ProxyTo is a backend URL requests are forwarded to instead of the success
+	// redirect, ProxyTimeout limits waiting for its response headers (30s default)
+	ProxyTo      string        `yaml:"proxy_to,omitempty"`
+	ProxyTimeout time.Duration `yaml:"proxy_timeout,omitempty"`
+
+	// CompressMinBytes overrides the global compress_min_bytes for bodies of
+	// respond and proxy_to, redirects are never compressed
+	CompressMinBytes int `yaml:"compress_min_bytes,omitempty"`
+
+	// Headers are set on redirects of the route, on top of the global ones
+	Headers map[string]string `yaml:"headers,omitempty"`
+
+	// SetCookies are written on redirects of the route
+	SetCookies []SetCookie `yaml:"set_cookies,omitempty"`
+
+	// BasicAuth requires credentials before conditions are evaluated, the global
+	// basic_auth config is used for routes without their own
+	BasicAuth *BasicAuthConfig `yaml:"basic_auth,omitempty"`
+
+	// templates are the compiled targets containing {{
+	templates map[string]*template.Template
+
+	// captures tells whether the route has a matches condition, $n in its
+	// targets only refers to groups then
+	captures bool
+}
+
+// enabled tells whether the route should be served, routes are enabled
+// unless set otherwise
+func (r Route) enabled() bool {
+	return r.Enabled == nil || *r.Enabled
+}
+
+// remainingPath returns the part of the request path appended to targets
+func (r Route) remainingPath(req *http.Request, ps httprouter.Params) string {
+	if r.StripPrefix != "" {
+		return strings.TrimPrefix(req.URL.Path, r.StripPrefix)
+	}
+
+	// Only catch-all parameters can contain slashes, and they always start with one
+	if n := len(ps); n > 0 && strings.HasPrefix(ps[n-1].Value, "/") {
+		return ps[n-1].Value
+	}
+
+	return req.URL.Path
+}
+
+// ParseConditions parses all the defined raw conditions in a route, including
+// the ones in its groups, and compiles its templated targets
+// Labels conditions can only refer to labels of conditions declared above them
+// in their own group or the groups enclosing it, conditions of other groups
+// may not have been evaluated, so label names have to be unique in the route
+// It returns a problem for every improperly configured condition, templates
+// are only compiled if there's none
+func (r *Route) ParseConditions() []Problem {
+	problems := r.group().parse(map[string]bool{}, map[string]bool{})
+	if len(problems) > 0 {
+		return problems
+	}
+
+	r.captures = false
+	for _, condition := range r.AllConditions() {
+		r.captures = r.captures || condition.Regexp != nil
+	}
+
+	err := r.parseTemplates()
+	if err != nil {
+		return []Problem{problemf("%v", err)}
 	}
-	// Test routes, feel free to delete them
-	router.GET("/panel", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-		fmt.Fprint(w, "Hello user, how are you?")
+
+	return nil
+}
+
+// AllConditions lists conditions of the route and all of its groups
+func (r *Route) AllConditions() []*Condition {
+	return r.group().allConditions()
+}
+
+// group returns the top level group of the route
+func (r *Route) group() *Group {
+	return &Group{Match: r.Match, Conditions: r.Conditions, Groups: r.Groups}
+}
+
+// Group is a set of conditions and nested groups combined with its own match
+// mode, conditions are evaluated before the groups, both in declared order
+type Group struct {
+	Match      string       `yaml:"match,omitempty"`
+	Conditions []*Condition `yaml:"conditions"`
+	Groups     []*Group     `yaml:"groups,omitempty"`
+}
+
+// parse parses conditions of the group and its nested groups, returning
+// problems of all of them, labels are the ones visible to the group and
+// defined all the ones of the route
+func (g *Group) parse(labels, defined map[string]bool) []Problem {
+	problems := []Problem{}
+	if g.Match != "" && g.Match != "all" && g.Match != "any" {
+		problems = append(problems, problemf("unknown match mode %q", g.Match))
+	}
+
+	for _, condition := range g.Conditions {
+		invalid := func(format string, args ...interface{}) {
+			problem := problemf(format, args...)
+			problem.Condition = condition.Raw
+			problems = append(problems, problem)
+		}
+
+		err := condition.Parse()
+		if err != nil {
+			invalid("%v", err)
+			continue
+		}
+
+		if condition.Type == "Labels" {
+			for _, label := range expressionLabels(condition.Expected) {
+				if !labels[label] {
+					invalid("unknown label %q", label)
+				}
+			}
+		}
+
+		if condition.Label != "" {
+			if defined[condition.Label] {
+				invalid("label %q is already defined", condition.Label)
+			}
+			labels[condition.Label] = true
+			defined[condition.Label] = true
+		}
+	}
+
+	for i, group := range g.Groups {
+		// Labels of sibling groups stay out of sight
+		visible := map[string]bool{}
+		for label := range labels {
+			visible[label] = true
+		}
+
+		for _, problem := range group.parse(visible, defined) {
+			if problem.Group == "" {
+				problem.Group = strconv.Itoa(i)
+			} else {
+				problem.Group = strconv.Itoa(i) + "." + problem.Group
+			}
+			problems = append(problems, problem)
+		}
+	}
+
+	// With match: any only conditions without a label or short-circuit target
+	// and groups decide, without any the group could never pass
+	// With match: all such a group always passes
+	if g.Match == "any" && !g.decides() {
+		problems = append(problems, problemf("match: any needs a condition without label and short_circuit_target or a group"))
+	}
+
+	return problems
+}
+
+// decides tells whether the group has conditions or groups deciding its result
+func (g *Group) decides() bool {
+	if len(g.Groups) > 0 {
+		return true
+	}
+
+	for _, condition := range g.Conditions {
+		if condition.Label == "" && condition.ShortCircuitTarget == "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (g *Group) allConditions() []*Condition {
+	conditions := append([]*Condition{}, g.Conditions...)
+	for _, group := range g.Groups {
+		conditions = append(conditions, group.allConditions()...)
+	}
+
+	return conditions
+}
+
+// Evaluate combines results of the conditions and nested groups, with match:
+// any the first passing one decides and with match: all the first failing one
+// It also returns the target of a short-circuit condition if one passed, in
+// which case the evaluation stops right away, and the failure redirect of the
+// condition which failed the group if it has one
+// With match: any no single condition fails the group, so there's none
+func (g *Group) Evaluate(req *http.Request) (bool, string, string) {
+	matchAny := g.Match == "any"
+
+	for _, condition := range g.Conditions {
+		passed := condition.Evaluate(req)
+
+		if passed && condition.ShortCircuitTarget != "" {
+			return true, condition.ShortCircuitTarget, ""
+		}
+
+		// Labelled and short-circuit conditions never decide about the group
+		if condition.ShortCircuitTarget != "" || condition.Label != "" {
+			continue
+		}
+
+		if passed && matchAny {
+			return true, "", ""
+		}
+
+		if !passed && !matchAny {
+			return false, "", condition.FailureRedirect
+		}
+	}
+
+	for _, group := range g.Groups {
+		passed, shortCircuitTarget, failureRedirect := group.Evaluate(req)
+		if shortCircuitTarget != "" {
+			return true, shortCircuitTarget, ""
+		}
+
+		if passed && matchAny {
+			return true, "", ""
+		}
+
+		if !passed && !matchAny {
+			return false, "", failureRedirect
+		}
+	}
+
+	return !matchAny, "", ""
+}
+
+// present tells whether the header, cookie or query parameter of the condition
+// is in the request, even if it's empty
+func (c *Condition) present(req *http.Request) bool {
+	switch c.Type {
+	case "Header":
+		return len(req.Header.Values(c.Key)) > 0
+	case "Cookie":
+		_, err := req.Cookie(c.Key)
+		return err == nil
+	case "Query":
+		_, ok := req.URL.Query()[c.Key]
+		return ok
+	}
+
+	return false
+}
+
+// requestState holds values shared by all conditions evaluated for a request
+type requestState struct {
+	// Path of the route, for logging
+	route string
+
+	velocity int
+
+	// Bucket is assigned once, so all Bucket conditions agree on it
+	bucket   string
+	assigned bool
+
+	// Labels of conditions which passed, conditions are evaluated in order
+	// so Labels conditions only ever see results of the ones above them
+	matched []string
+
+	// Submatches of the last passed matches condition
+	submatches []string
+
+	// Checked conditions are recorded when explaining a decision
+	tracing bool
+	trace   []ConditionTrace
+}
+
+type requestStateKey struct{}
+
+// stateOf returns the state of a request being routed, requests evaluated
+// outside of a route handler get an empty one
+func stateOf(req *http.Request) *requestState {
+	if state, ok := req.Context().Value(requestStateKey{}).(*requestState); ok {
+		return state
+	}
+
+	return &requestState{}
+}
+
+// BuildHandler creates httprouter.Handle function to do the routing with
+// the data specified on the route
+func (r Route) BuildHandler() httprouter.Handle {
+	// round_robin counters and rate limits start over when the config
+	// is reloaded, buildRouter registers the handler for every method of the
+	// route so they're shared by all of them
+	var turn uint64
+
+	var limiter *rateLimiter
+	if r.RateLimit != nil {
+		limiter = newRateLimiter(r.RateLimit)
+	}
+
+	var proxy *httputil.ReverseProxy
+	if r.ProxyTo != "" {
+		// Validated along with the rest of the config
+		backend, _ := url.Parse(r.ProxyTo)
+		proxy = newProxy(backend, r.proxyTimeout())
+	}
+
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		if recorder, ok := w.(*responseRecorder); ok {
+			recorder.route = r.Path
+		}
+
+		if r.CORS != nil {
+			r.CORS.allowOrigin(w, req)
+		}
+
+		start := time.Now()
+		publish := func(target, result string, status int) {
+			metrics.Observe(r.Path, result, time.Since(start))
+
+			if events != nil {
+				events.Publish(DecisionEvent{
+					Time:      time.Now(),
+					Route:     r.Path,
+					Method:    req.Method,
+					Path:      req.URL.Path,
+					ClientIP:  clientIP(req),
+					UserAgent: req.Header.Get("User-Agent"),
+					Result:    result,
+					Target:    target,
+					Status:    status,
+					RequestID: requestID(req.Context()),
+				})
+			}
+		}
+
+		state := &requestState{route: r.Path}
+		redirect := func(target, result string) {
+			// http.Redirect writes the status, later headers would be dropped
+			for name, value := range r.Headers {
+				w.Header().Set(name, value)
+			}
+			for _, cookie := range r.SetCookies {
+				http.SetCookie(w, cookie.cookie(r.substitute(cookie.Value, ps, state.submatches)))
+			}
+
+			publish(target, result, r.RedirectStatus)
+			http.Redirect(w, req, target, r.RedirectStatus)
+		}
+
+		if limiter != nil && !limiter.Allow(clientIP(req)) {
+			publish("", "rate_limited", http.StatusTooManyRequests)
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+
+		if r.BasicAuth != nil && !r.BasicAuth.authorized(w, req) {
+			publish("", "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		// Every routed request counts towards the velocity of its User-Agent
+		if velocity := current.Load().(*live).velocity; velocity != nil {
+			state.velocity = velocity.Hit(req.Header.Get("User-Agent"))
+		}
+		req = req.WithContext(context.WithValue(req.Context(), requestStateKey{}, state))
+
+		d := r.decide(req, ps, &turn)
+		for name, values := range d.header {
+			for _, value := range values {
+				w.Header().Add(name, value)
+			}
+		}
+
+		switch {
+		case d.result != "success":
+			redirect(d.target, d.result)
+		case proxy != nil:
+			// write_timeout counts from reading the request, it's extended so
+			// a slow backend gets a 502 after proxy_timeout instead of a
+			// connection cut off before
+			deadline := time.Now().Add(r.proxyTimeout() + currentConfig().writeTimeout())
+			http.NewResponseController(w).SetWriteDeadline(deadline)
+
+			recorder := &responseRecorder{ResponseWriter: w}
+			if minBytes := r.compressMinBytes(currentConfig()); minBytes > 0 {
+				compressor := newCompressWriter(w, req, minBytes)
+				defer compressor.Close()
+				recorder.ResponseWriter = compressor
+			}
+
+			proxy.ServeHTTP(recorder, req)
+			publish(d.target, d.result, recorder.status)
+		case r.Respond != nil:
+			publish("", d.result, d.status)
+			if minBytes := r.compressMinBytes(currentConfig()); minBytes > 0 {
+				compressor := newCompressWriter(w, req, minBytes)
+				defer compressor.Close()
+				w = compressor
+			}
+			r.Respond.ServeHTTP(w, req)
+		default:
+			redirect(d.target, d.result)
+		}
+	}
+}
+
+// decision is where a route sends a request, worked out without writing the
+// response
+type decision struct {
+	// result is short_circuit, failure or success
+	result string
+
+	// target is the expanded redirect target, or the backend with proxy_to
+	target string
+
+	// status is the status of the response, 0 when it's proxied
+	status int
+
+	// header holds headers the response needs (Vary, Set-Cookie)
+	header http.Header
+}
+
+// decide evaluates conditions of the route for req, which has to carry its
+// requestState, and picks the target, turn counts requests of the route for
+// round_robin targets
+func (r Route) decide(req *http.Request, ps httprouter.Params, turn *uint64) decision {
+	d := decision{result: "success", status: r.RedirectStatus, header: http.Header{}}
+
+	passed, shortCircuitTarget, failureRedirect := r.group().Evaluate(req)
+	if r.Invert {
+		passed, failureRedirect = !passed, ""
+	}
+
+	switch {
+	case shortCircuitTarget != "":
+		d.result = "short_circuit"
+		d.target = r.redirectTarget(shortCircuitTarget, req, ps, nil)
+	case !passed:
+		if failureRedirect == "" {
+			failureRedirect = r.FailureRedirect
+		}
+		d.result = "failure"
+		d.target = r.redirectTarget(failureRedirect, req, ps, nil)
+	case r.ProxyTo != "":
+		d.target, d.status = r.ProxyTo, 0
+	case r.Respond != nil:
+		d.status = r.Respond.Status
+	default:
+		target := r.successTarget(d.header, req, turn)
+		d.target = r.redirectTarget(target, req, ps, stateOf(req).submatches)
+	}
+
+	return d
+}
+
+// redirectTarget expands templated targets, fills in submatches and path
+// parameters of target and appends path and query of the request if the route
+// is set to
+func (r Route) redirectTarget(target string, req *http.Request, ps httprouter.Params, submatches []string) string {
+	target = r.substitute(r.expand(target, req, ps), ps, submatches)
+	if r.AppendPath {
+		target = withPath(target, r.remainingPath(req, ps))
+	}
+	if r.PreserveQuery {
+		target = withQuery(target, req.URL.RawQuery)
+	}
+
+	return target
+}
+
+// substitute fills in submatches, if the route has a matches condition, and
+// path parameters of value
+func (r Route) substitute(value string, ps httprouter.Params, submatches []string) string {
+	if r.captures {
+		value = withSubmatches(value, submatches)
+	}
+
+	return withParams(value, ps)
+}
+
+// paramPlaceholder matches :name placeholders of path parameters in targets
+var paramPlaceholder = regexp.MustCompile(`:[A-Za-z_][A-Za-z0-9_]*`)
+
+// withParams replaces :name placeholders in target with values of path
+// parameters captured by the route, placeholders without a parameter of
+// that name are left as they are
+// Values of catch-all parameters are escaped segment by segment, keeping
+// their slashes
+func withParams(target string, ps httprouter.Params) string {
+	if len(ps) == 0 {
+		return target
+	}
+
+	return paramPlaceholder.ReplaceAllStringFunc(target, func(placeholder string) string {
+		for _, p := range ps {
+			if p.Key != placeholder[1:] {
+				continue
+			}
+
+			// Only catch-all parameters can contain slashes
+			segments := strings.Split(p.Value, "/")
+			for i, segment := range segments {
+				segments[i] = url.PathEscape(segment)
+			}
+			return strings.Join(segments, "/")
+		}
+
+		return placeholder
 	})
-	router.GET("/bye", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-		fmt.Fprint(w, "Nothing here! Bye!!!")
+}
+
+// submatchReference matches $1, $2, ... references to regexp groups in targets
+// and $$, an escaped $
+var submatchReference = regexp.MustCompile(`\$(\$|[0-9]+)`)
+
+// withSubmatches replaces $n references in target with groups of the last
+// passed matches condition and $$ with $
+// Groups which didn't participate in the match, don't exist or references
+// without any passed matches condition are replaced with empty strings
+func withSubmatches(target string, submatches []string) string {
+	return submatchReference.ReplaceAllStringFunc(target, func(reference string) string {
+		if reference == "$$" {
+			return "$"
+		}
+
+		n, _ := strconv.Atoi(reference[1:])
+		if n < len(submatches) {
+			return submatches[n]
+		}
+
+		return ""
 	})
+}
+
+// withPath appends path to the path of target with a single slash between them
+func withPath(target, path string) string {
+	if path == "" {
+		return target
+	}
 
-	for path, route := range config.Routes {
-		route.ParseConditions()
-		for _, method := range route.AllowedMethods {
-			router.Handle(method, path, route.BuildHandler())
+	u, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.TrimPrefix(path, "/")
+	u.RawPath = ""
+
+	return u.String()
+}
+
+// withQuery appends rawQuery to the query of target, keeping its fragment last
+func withQuery(target, rawQuery string) string {
+	if rawQuery == "" {
+		return target
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+
+	if u.RawQuery != "" {
+		u.RawQuery += "&"
+	}
+	u.RawQuery += rawQuery
+
+	return u.String()
+}
+
+// geoip resolves client IPs for Geo conditions, it's opened once at startup
+// if geoip_db is configured
+var geoip *geoip2.Reader
+
+// events publishes redirect decisions, it's only set up when a sink is configured
+var events *eventQueue
+
+// loadConfig reads and unmarshals the config file at path along with routes
+// of all the files it includes
+func loadConfig(path string) (Config, error) {
+	c, err := loadFile(path, path)
+	if err != nil {
+		return c, err
+	}
+
+	sources := map[string]string{}
+	for route := range c.Routes {
+		sources[route] = path
+	}
+
+	err = c.include(path, path, c.Include, sources, 1)
+	c.sources = sources
+	return c, err
+}
+
+// loadFile reads and unmarshals a single config file, local or at an http(s)
+// URL, its format is picked by the extension: .json, .toml or YAML for anything else
+// Other formats are converted to YAML first, so they're decoded by exactly the
+// same rules, including conditions and durations written as strings
+// root is the top-level config path belongs to, see readConfigFile
+func loadFile(path, root string) (Config, error) {
+	c := Config{}
+
+	file, err := readConfigFile(path, root)
+	if err != nil {
+		return c, fmt.Errorf("cannot read %s: %v", path, err)
+	}
+
+	switch configExt(path) {
+	case ".json":
+		file, err = toYAML(file, json.Unmarshal)
+	case ".toml":
+		file, err = toYAML(file, toml.Unmarshal)
+	}
+	if err != nil {
+		return c, fmt.Errorf("failed loading %s: %v", path, err)
+	}
+
+	err = yaml.Unmarshal(file, &c)
+	if err != nil {
+		return c, fmt.Errorf("failed loading %s: %v", path, err)
+	}
+
+	return c, nil
+}
+
+// toYAML decodes a config with unmarshal and encodes it as YAML
+func toYAML(file []byte, unmarshal func([]byte, interface{}) error) ([]byte, error) {
+	var config interface{}
+	err := unmarshal(file, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	return yaml.Marshal(config)
+}
+
+// logRoutes logs the loaded routes with their targets, methods and conditions
+func logRoutes(c Config) {
+	for path, route := range c.Routes {
+		conditions := []string{}
+		for _, condition := range route.AllConditions() {
+			conditions = append(conditions, condition.Raw)
+		}
+
+		slog.Info("Loaded route", "path", path, "success_redirect", route.SuccessRedirect,
+			"failure_redirect", route.FailureRedirect, "methods", route.AllowedMethods, "conditions", conditions)
+	}
+}
+
+func main() {
+	configPath := flag.String("config", "./config.yaml", "path to the config file, takes precedence over TOASTED_CONFIG")
+	check := flag.Bool("check", false, "validate the config, print the routes and exit without serving")
+	dump := flag.Bool("dump", false, "validate the config, print the parsed routes as JSON and exit without serving")
+	format := flag.String("format", "text", "output of -check, text or json")
+	flag.Parse()
+
+	if *format != "text" && *format != "json" {
+		log.Fatalf("unknown format %q", *format)
+	}
+	if *format != "text" && !*check {
+		log.Fatal("-format is only used with -check")
+	}
+
+	// Precedence: -config flag, TOASTED_CONFIG environment variable, ./config.yaml
+	configSet := false
+	flag.Visit(func(f *flag.Flag) {
+		configSet = configSet || f.Name == "config"
+	})
+	if env := os.Getenv("TOASTED_CONFIG"); env != "" && !configSet {
+		*configPath = env
+	}
+
+	// Logging is configured by the config itself, so problems with it are
+	// reported as plain text
+	config, err := loadConfig(*configPath)
+	if err == nil {
+		err = config.Validate()
+	}
+
+	if *format == "json" {
+		report := checkReport(err)
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+		if !report.Valid {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *dump {
+		err = dumpRoutes(os.Stdout, &config)
+		if err != nil {
+			log.Fatal(err)
 		}
+		return
+	}
+
+	// -check reports to stdout, where CI reads it, leaving log_file alone
+	if *check {
+		config.LogFile = ""
+	}
+
+	err = configureLogging(&config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logRoutes(config)
+
+	if *check {
+		slog.Info("Config is valid", "path", *configPath)
+		return
+	}
+
+	if config.Events.Webhook != "" {
+		queueSize, timeout := config.Events.QueueSize, config.Events.Timeout
+		if queueSize <= 0 {
+			queueSize = 1000
+		}
+		if timeout <= 0 {
+			timeout = 5 * time.Second
+		}
+
+		slog.Info("Publishing events", "webhook", config.Events.Webhook)
+		events = newEventQueue(WebhookSink{URL: config.Events.Webhook, Client: &http.Client{Timeout: timeout}}, queueSize)
+	}
+
+	if config.GeoIPDB != "" {
+		reader, err := geoip2.Open(config.GeoIPDB)
+		if err != nil {
+			fatal("Cannot open GeoIP database", "error", err)
+		}
+		defer reader.Close()
+
+		slog.Info("GeoIP database loaded", "path", config.GeoIPDB)
+		geoip = reader
+	}
+
+	configSource = *configPath
+	install(&config)
+	reloadOnSIGHUP(*configPath)
+
+	// Automatic TLS needs the standard ports for Let's Encrypt to reach it
+	address := config.Address
+	if config.AutoTLS.Enabled() {
+		address = ":443"
+	}
+
+	listener, err := listen(address)
+	if err != nil {
+		fatal("Cannot listen", "address", address, "error", err)
+	}
+
+	// Clients of unix sockets have no IP to tell them apart
+	if _, tcp := listener.Addr().(*net.TCPAddr); config.MaxConnsPerIP > 0 && !tcp {
+		slog.Warn("Connection limit only applies to TCP listeners, ignoring max_conns_per_ip", "address", address)
+	} else if config.MaxConnsPerIP > 0 {
+		slog.Info("Connection limit is on", "max_conns_per_ip", config.MaxConnsPerIP, "mode", config.ConnLimitMode)
+		listener = newConnLimitListener(listener, config.MaxConnsPerIP, config.ConnLimitMode == "queue", config.ConnQueueTimeout)
+	}
+
+	server := newServer(&config, withRequestID(withAccessLog(withIPFilter(withBodyLimit(liveHandler{})))))
+
+	if config.TLSCert != "" || config.AutoTLS.Enabled() {
+		server.TLSConfig = &tls.Config{}
+		if config.AutoTLS.Enabled() {
+			server.TLSConfig = autoTLS(&config)
+		} else if config.RedirectHTTPToHTTPS {
+			redirects := newServer(&config, httpsRedirect(address))
+			redirects.Addr = ":80"
+			go func() {
+				fatal("HTTPS redirect server stopped", "error", redirects.ListenAndServe())
+			}()
+		}
+		if config.TLSMinVersion != "" {
+			server.TLSConfig.MinVersion = tlsVersions[normalizeTLSVersion(config.TLSMinVersion)]
+		}
+
+		slog.Info("Server started with TLS", "address", address)
+		fatal("Server stopped", "error", server.ServeTLS(listener, config.TLSCert, config.TLSKey))
 	}
 
-	fmt.Println("Server started on port", config.Address)
-	log.Fatal(http.ListenAndServe(config.Address, router))
+	slog.Info("Server started", "address", address)
+	fatal("Server stopped", "error", server.Serve(listener))
 }
@@ -0,0 +1,110 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseProblems(t *testing.T) {
+	tests := []struct {
+		raw     string
+		problem string
+	}{
+		{raw: "Cron within 2h 0 9 * * MON"},
+		{raw: "Cron within 0s 0 9 * * MON", problem: "window has to be positive, got 0s"},
+		{raw: "Cron within -1h 0 9 * * MON", problem: "window has to be positive, got -1h"},
+		{raw: "Cron within 2h 0 9 * *", problem: "invalid cron expression"},
+		{raw: "Query:utm_source is newsletter"},
+		{raw: "Query: is newsletter", problem: "Query needs a key"},
+		{raw: "Query is newsletter", problem: "Query needs a key"},
+		{raw: "Header: is x", problem: "Header needs a key"},
+		{raw: "Header: exists", problem: "Header needs a key"},
+		{raw: "Cookie: is x", problem: "Cookie needs a key"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.raw, func(t *testing.T) {
+			err := (&Condition{Raw: test.raw}).Parse()
+			if test.problem == "" {
+				if err != nil {
+					t.Fatalf("expected a valid condition, got %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), test.problem) {
+				t.Fatalf("expected problem %q, got %v", test.problem, err)
+			}
+		})
+	}
+}
+
+// Time conditions used to parse both the current and the expected time on
+// every request, Parse now parses the expected one once and Evaluate passes
+// the current time without formatting and parsing it
+
+func timeCondition(b *testing.B) *Condition {
+	c := &Condition{Raw: "Time lt 2018-10-28T20:00:00+01:00"}
+	err := c.Parse()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return c
+}
+
+func BenchmarkTimeBefore(b *testing.B) {
+	c := timeCondition(b)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		actual, err := time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+		if err != nil {
+			b.Fatal(err)
+		}
+		expected, err := time.Parse(time.RFC3339, c.Expected)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_ = actual.Before(expected)
+	}
+}
+
+func BenchmarkTimeAfter(b *testing.B) {
+	c := timeCondition(b)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		c.CompareFunc(time.Now().Format(time.RFC3339), c.Expected)
+	}
+}
+
+func BenchmarkTimeDirect(b *testing.B) {
+	c := timeCondition(b)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		c.TimeCompareFunc(time.Now())
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricsConfig configures the Prometheus metrics endpoint, protected
+// metrics (and /debug/vars) require the admin credentials
+type MetricsConfig struct {
+	Disabled  bool   `yaml:"disabled,omitempty"`
+	Path      string `yaml:"path,omitempty"`
+	Protected bool   `yaml:"protected,omitempty"`
+}
+
+// path returns path of the endpoint, /metrics unless configured
+func (m MetricsConfig) path() string {
+	if m.Path == "" {
+		return "/metrics"
+	}
+
+	return m.Path
+}
+
+// latencyBuckets are upper bounds of the handler latency histogram in seconds
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+type requestsKey struct {
+	route  string
+	result string
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// metricsRegistry counts resolved requests and their latency per route
+// It's kept across config reloads, so counters only reset on restart
+// Exposed in the Prometheus text format, hand-rolled as there are just two metrics
+type metricsRegistry struct {
+	mu       sync.Mutex
+	requests map[requestsKey]uint64
+	latency  map[string]*histogram
+}
+
+var metrics = &metricsRegistry{
+	requests: map[requestsKey]uint64{},
+	latency:  map[string]*histogram{},
+}
+
+// NotFound records a request which didn't match any route
+func (m *metricsRegistry) NotFound() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[requestsKey{"", "not_found"}]++
+}
+
+// Observe records a request to route resolved with result
+func (m *metricsRegistry) Observe(route, result string, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[requestsKey{route, result}]++
+
+	h, ok := m.latency[route]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latency[route] = h
+	}
+
+	seconds := duration.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// ServeHTTP writes all metrics, sorted so the output is stable
+func (m *metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	keys := make([]requestsKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].result < keys[j].result
+	})
+
+	fmt.Fprintln(w, "# HELP toasted_requests_total Requests by route and how they were resolved.")
+	fmt.Fprintln(w, "# TYPE toasted_requests_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "toasted_requests_total{route=%s,result=%s} %d\n", labelValue(key.route), labelValue(key.result), m.requests[key])
+	}
+
+	routes := make([]string, 0, len(m.latency))
+	for route := range m.latency {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	fmt.Fprintln(w, "# HELP toasted_request_duration_seconds Time spent handling requests by route.")
+	fmt.Fprintln(w, "# TYPE toasted_request_duration_seconds histogram")
+	for _, route := range routes {
+		h := m.latency[route]
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "toasted_request_duration_seconds_bucket{route=%s,le=\"%g\"} %d\n", labelValue(route), bound, h.counts[i])
+		}
+		fmt.Fprintf(w, "toasted_request_duration_seconds_bucket{route=%s,le=\"+Inf\"} %d\n", labelValue(route), h.count)
+		fmt.Fprintf(w, "toasted_request_duration_seconds_sum{route=%s} %g\n", labelValue(route), h.sum)
+		fmt.Fprintf(w, "toasted_request_duration_seconds_count{route=%s} %d\n", labelValue(route), h.count)
+	}
+}
+
+// labelValue quotes a label value escaping it as the text format requires
+func labelValue(value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return `"` + value + `"`
+}
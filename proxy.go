@@ -0,0 +1,65 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+)
+
+// proxyTimeout limits waiting for response headers of the backend, 30s unless
+// configured
+func (r Route) proxyTimeout() time.Duration {
+	if r.ProxyTimeout <= 0 {
+		return 30 * time.Second
+	}
+
+	return r.ProxyTimeout
+}
+
+// newProxy creates a reverse proxy forwarding requests to backend, keeping
+// their path and query and telling the backend where they came from
+func newProxy(backend *url.URL, timeout time.Duration) *httputil.ReverseProxy {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = timeout
+
+	proxy := httputil.NewSingleHostReverseProxy(backend)
+	proxy.Transport = transport
+
+	// X-Forwarded-For is added by the proxy itself
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+		req.Header.Set("X-Forwarded-Proto", requestScheme(req))
+
+		director(req)
+	}
+
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		slog.WarnContext(req.Context(), "Proxying failed", "backend", backend.String(), "error", err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+
+	return proxy
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimitConfig limits requests to a route per client IP
+// Clients get Burst requests at once (RequestsPerMinute by default), refilled
+// at RequestsPerMinute, clients within the Exempt ranges aren't limited
+type RateLimitConfig struct {
+	RequestsPerMinute int      `yaml:"requests_per_minute"`
+	Burst             int      `yaml:"burst,omitempty"`
+	Exempt            []string `yaml:"exempt,omitempty"`
+
+	exempt []*net.IPNet
+}
+
+// load checks the limit and parses the exempt ranges
+func (c *RateLimitConfig) load() error {
+	if c.RequestsPerMinute <= 0 {
+		return fmt.Errorf("requests_per_minute has to be positive")
+	}
+	if c.Burst < 0 {
+		return fmt.Errorf("burst can't be negative")
+	}
+
+	c.exempt = nil
+	for _, cidr := range c.Exempt {
+		network, err := parseNetwork(cidr)
+		if err != nil {
+			return err
+		}
+		c.exempt = append(c.exempt, network)
+	}
+
+	return nil
+}
+
+// rateCleanupInterval is how often buckets which refilled completely are
+// dropped, they're the same as new ones
+const rateCleanupInterval = time.Minute
+
+// rateLimiter keeps a token bucket per client IP
+type rateLimiter struct {
+	config *RateLimitConfig
+	rate   float64 // tokens per second
+	burst  float64
+
+	mu          sync.Mutex
+	buckets     map[string]*tokenBucket
+	lastCleanup time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(config *RateLimitConfig) *rateLimiter {
+	burst := config.Burst
+	if burst == 0 {
+		burst = config.RequestsPerMinute
+	}
+
+	return &rateLimiter{
+		config:      config,
+		rate:        float64(config.RequestsPerMinute) / 60,
+		burst:       float64(burst),
+		buckets:     map[string]*tokenBucket{},
+		lastCleanup: time.Now(),
+	}
+}
+
+// Allow takes a token of the client IP, it returns false if there's none left
+func (l *rateLimiter) Allow(ip string) bool {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		for _, network := range l.config.exempt {
+			if network.Contains(parsed) {
+				return true
+			}
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastCleanup) >= rateCleanupInterval {
+		l.cleanup(now)
+	}
+
+	bucket, ok := l.buckets[ip]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[ip] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() * l.rate
+	if bucket.tokens > l.burst {
+		bucket.tokens = l.burst
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+
+	bucket.tokens--
+	return true
+}
+
+// cleanup drops buckets which would be full by now
+func (l *rateLimiter) cleanup(now time.Time) {
+	for ip, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, ip)
+		}
+	}
+
+	l.lastCleanup = now
+}
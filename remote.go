@@ -0,0 +1,131 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// remoteTimeout limits fetching of a remote config file
+const remoteTimeout = 10 * time.Second
+
+// maxRemoteBytes limits the size of a remote config file
+const maxRemoteBytes = 10 << 20
+
+// isRemote tells whether a config path is an http(s) URL
+func isRemote(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// readConfigFile reads a local config file or fetches a remote one, root is
+// the top-level config the file belongs to
+// Remote ones are requested with the Authorization header set to
+// TOASTED_CONFIG_AUTHORIZATION, if it's set and they're on the https host of
+// root, so an included URL can't get hold of it. It can be a file: or env:
+// secret like the ones in the config
+func readConfigFile(source, root string) ([]byte, error) {
+	if !isRemote(source) {
+		return ioutil.ReadFile(source)
+	}
+
+	req, err := http.NewRequest("GET", source, nil)
+	if err != nil {
+		return nil, err
+	}
+	if auth := os.Getenv("TOASTED_CONFIG_AUTHORIZATION"); auth != "" {
+		if strings.HasPrefix(root, "http://") {
+			return nil, fmt.Errorf("TOASTED_CONFIG_AUTHORIZATION is only sent over https")
+		}
+		if sameHost(root, req.URL) {
+			resolved, err := resolveSecret(auth)
+			if err != nil {
+				return nil, fmt.Errorf("TOASTED_CONFIG_AUTHORIZATION: %v", err)
+			}
+			req.Header.Set("Authorization", resolved)
+		}
+	}
+
+	client := &http.Client{Timeout: remoteTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	// One byte over the limit tells a file of exactly maxRemoteBytes from a
+	// larger one
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxRemoteBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxRemoteBytes {
+		return nil, fmt.Errorf("config is larger than %d bytes", maxRemoteBytes)
+	}
+
+	return body, nil
+}
+
+// sameHost tells whether u is an https URL on the host of root
+func sameHost(root string, u *url.URL) bool {
+	base, err := url.Parse(root)
+	if err != nil {
+		return false
+	}
+
+	return u.Scheme == "https" && base.Scheme == "https" && strings.EqualFold(u.Host, base.Host)
+}
+
+// configExt returns extension of a config path, ignoring query of URLs
+func configExt(source string) string {
+	if u, err := url.Parse(source); err == nil && isRemote(source) {
+		return strings.ToLower(path.Ext(u.Path))
+	}
+
+	return strings.ToLower(path.Ext(source))
+}
+
+// resolveRemote resolves an include of a remote config against its URL,
+// remote includes can't be globs
+func resolveRemote(from, include string) (string, error) {
+	base, err := url.Parse(from)
+	if err != nil {
+		return "", err
+	}
+
+	ref, err := url.Parse(include)
+	if err != nil {
+		return "", err
+	}
+
+	return base.ResolveReference(ref).String(), nil
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+type requestIDKey struct{}
+
+// requestID returns ID of the request the context belongs to, if it has one
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestID takes the X-Request-ID of requests or, unless turned off with
+// generate_request_id, generates one, echoes it on the response and keeps it in
+// the request context for logs and events
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		// Overly long IDs are more likely abuse than tracing
+		if len(id) > 128 {
+			id = ""
+		}
+
+		config := currentConfig()
+		if id == "" && (config.GenerateRequestID == nil || *config.GenerateRequestID) {
+			id = newRequestID()
+		}
+
+		if id != "" {
+			// Also set on the request, so proxied backends get it too
+			r.Header.Set("X-Request-ID", id)
+			w.Header().Set("X-Request-ID", id)
+			r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newRequestID generates a random (version 4) UUID
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
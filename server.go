@@ -0,0 +1,561 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// live is everything requests are currently served with, it's replaced as
+// a whole when the config is reloaded, so requests already being handled
+// finish with the router they started with
+type live struct {
+	config   *Config
+	router   http.Handler
+	velocity *velocityTracker
+}
+
+// current holds the *live in use
+var current atomic.Value
+
+// currentConfig returns the config requests are currently served with
+func currentConfig() *Config {
+	return current.Load().(*live).config
+}
+
+// liveHandler passes requests to the router of the current config
+type liveHandler struct{}
+
+func (liveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	current.Load().(*live).router.ServeHTTP(w, r)
+}
+
+// install builds a router for the validated config and starts serving with it
+func install(config *Config) {
+	var previous *live
+	if l, ok := current.Load().(*live); ok {
+		previous = l
+	}
+
+	next := &live{config: config, router: buildRouter(config)}
+
+	for _, route := range config.Routes {
+		for _, condition := range route.AllConditions() {
+			if condition.Type != "UAVelocity" || next.velocity != nil {
+				continue
+			}
+
+			window, maxKeys := config.UAVelocityWindow, config.UAVelocityMaxKeys
+			if window <= 0 {
+				window = time.Minute
+			}
+			if maxKeys <= 0 {
+				maxKeys = 10000
+			}
+
+			// Counters survive reloads which don't change how they're kept
+			if previous != nil && previous.velocity != nil && previous.velocity.window == window && previous.velocity.maxKeys == maxKeys {
+				next.velocity = previous.velocity
+			} else {
+				next.velocity = newVelocityTracker(window, maxKeys)
+			}
+		}
+	}
+
+	current.Store(next)
+}
+
+// healthPath returns path of the health check, /healthz unless configured
+func (c *Config) healthPath() string {
+	if c.HealthPath == "" {
+		return "/healthz"
+	}
+
+	return c.HealthPath
+}
+
+// buildRouter creates a router serving routes of the config
+func buildRouter(config *Config) *httprouter.Router {
+	router := httprouter.New()
+
+	// Answered by routes themselves, httprouter lists methods in random order
+	router.HandleOPTIONS = false
+
+	if config.NotFoundRedirect != "" {
+		status := config.NotFoundRedirectStatus
+		if status == 0 {
+			status = config.defaultRedirectStatus()
+		}
+
+		slog.Info("Not found redirect is on", "target", config.NotFoundRedirect, "status", status)
+		router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			metrics.NotFound()
+			http.Redirect(w, r, config.NotFoundRedirect, status)
+		})
+	} else if config.notFound != nil {
+		slog.Info("Not found redirect is off, returning the configured response", "status", config.notFound.Status)
+		router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			metrics.NotFound()
+			config.notFound.ServeHTTP(w, r)
+		})
+	} else {
+		slog.Info("Not found redirect is off, returning 404s")
+		router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			metrics.NotFound()
+			http.NotFound(w, r)
+		})
+	}
+
+	if config.MethodNotAllowedRedirect != "" {
+		status := config.MethodNotAllowedRedirectStatus
+		if status == 0 {
+			status = config.defaultRedirectStatus()
+		}
+
+		slog.Info("Method not allowed redirect is on", "target", config.MethodNotAllowedRedirect, "status", status)
+		router.MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, config.MethodNotAllowedRedirect, status)
+		})
+	}
+
+	// Targets of the example config, routes of the config take precedence
+	if config.ExampleRoutes {
+		examples := map[string]string{
+			"/panel": "Hello user, how are you?",
+			"/bye":   "Nothing here! Bye!!!",
+		}
+		for path, body := range examples {
+			if _, ok := config.Routes[path]; ok {
+				continue
+			}
+
+			body := body
+			router.GET(path, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+				fmt.Fprint(w, body)
+			})
+		}
+	}
+
+	if events != nil {
+		vars := expvar.Handler()
+		if config.Metrics.Protected {
+			vars = config.Admin.protect(vars)
+		}
+		router.Handler("GET", "/debug/vars", vars)
+	}
+
+	// Answered before any route conditions, for load balancers and probes
+	health := func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		fmt.Fprint(w, "OK")
+	}
+	router.GET(config.healthPath(), health)
+	router.HEAD(config.healthPath(), health)
+
+	if !config.Metrics.Disabled {
+		var handler http.Handler = metrics
+		if config.Metrics.Protected {
+			handler = config.Admin.protect(handler)
+		}
+		router.Handler("GET", config.Metrics.path(), handler)
+	}
+
+	if config.Admin.enabled() {
+		router.Handler("POST", config.Admin.reloadPath(), adminReload(config.Admin))
+		router.Handler("GET", config.Admin.explainPath(), adminExplain(config.Admin))
+		router.Handle("POST", config.Admin.routesPath()+"/*route", adminToggleRoute(config.Admin))
+	}
+
+	for path, route := range config.Routes {
+		if !route.enabled() {
+			slog.Info("Skipping disabled route", "path", path)
+			continue
+		}
+
+		// Metrics, access logs and events name the route by its registered
+		// path, path: of the route may differ or be missing
+		route.Path = path
+		route.AllowedMethods = config.methods(route)
+		if route.CORS == nil {
+			route.CORS = config.CORS
+		}
+		if route.BasicAuth == nil {
+			route.BasicAuth = config.BasicAuth
+		}
+		route.Headers = mergeHeaders(config.Headers, route.Headers)
+
+		// A catch-all at the root would conflict with every other path, so it's
+		// served for requests none of them match instead
+		options := config.optionsHandler(route)
+		if name, ok := rootCatchAll(path); ok {
+			router.NotFound = route.fallback(name, options, router.NotFound)
+			continue
+		}
+
+		// One handler for all the methods, so they share the rate limit and
+		// round_robin turns of the route
+		handle := route.BuildHandler()
+		for _, method := range route.AllowedMethods {
+			router.Handle(method, path, handle)
+		}
+
+		if options != nil {
+			router.Handler("OPTIONS", path, options)
+		}
+	}
+
+	return router
+}
+
+// methods returns the methods route is served for, HEAD is added to routes
+// allowing GET unless auto_head is off
+func (c *Config) methods(route Route) []string {
+	if c.AutoHEAD != nil && !*c.AutoHEAD {
+		return route.AllowedMethods
+	}
+
+	hasGET, hasHEAD := false, false
+	for _, method := range route.AllowedMethods {
+		hasGET = hasGET || method == "GET"
+		hasHEAD = hasHEAD || method == "HEAD"
+	}
+	if !hasGET || hasHEAD {
+		return route.AllowedMethods
+	}
+
+	return append(append([]string{}, route.AllowedMethods...), "HEAD")
+}
+
+// autoOPTIONS tells whether OPTIONS requests to routes are answered with their
+// allowed methods, on unless auto_options is false
+func (c *Config) autoOPTIONS() bool {
+	return c.AutoOPTIONS == nil || *c.AutoOPTIONS
+}
+
+// optionsHandler returns the handler of OPTIONS requests to route, the CORS
+// preflight or one listing the allowed methods, nil if the route handles them
+// itself or they aren't answered
+func (c *Config) optionsHandler(route Route) http.Handler {
+	if route.CORS != nil {
+		return route.CORS.preflight(route.AllowedMethods)
+	}
+
+	for _, method := range route.AllowedMethods {
+		if method == "OPTIONS" {
+			return nil
+		}
+	}
+
+	if !c.autoOPTIONS() {
+		return nil
+	}
+
+	allow := strings.Join(append([]string{"OPTIONS"}, route.AllowedMethods...), ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", allow)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// mergeHeaders returns the global headers overridden by the ones of a route
+func mergeHeaders(global, route map[string]string) map[string]string {
+	merged := make(map[string]string, len(global)+len(route))
+	for name, value := range global {
+		merged[name] = value
+	}
+	for name, value := range route {
+		merged[name] = value
+	}
+
+	return merged
+}
+
+// rootCatchAll returns name of the parameter if path is a catch-all at the
+// root, like /*rest
+func rootCatchAll(path string) (string, bool) {
+	if !strings.HasPrefix(path, "/*") || strings.Contains(path[1:], "/") {
+		return "", false
+	}
+
+	return path[2:], true
+}
+
+// fallback serves requests no other route matched with the route, the whole
+// path being its catch-all parameter, and OPTIONS requests with options
+// Requests with methods the route doesn't allow are passed to notFound
+func (r Route) fallback(name string, options, notFound http.Handler) http.Handler {
+	handle := r.BuildHandler()
+	allowed := map[string]bool{}
+	for _, method := range r.AllowedMethods {
+		allowed[method] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case allowed[req.Method]:
+			handle(w, req, httprouter.Params{{Key: name, Value: req.URL.Path}})
+		case req.Method == "OPTIONS" && options != nil:
+			options.ServeHTTP(w, req)
+		default:
+			notFound.ServeHTTP(w, req)
+		}
+	})
+}
+
+// newServer creates a server with timeouts of the config, so slow clients can't
+// hold connections open forever
+func newServer(config *Config, handler http.Handler) *http.Server {
+	server := &http.Server{
+		Handler:      handler,
+		ReadTimeout:  config.ReadTimeout,
+		WriteTimeout: config.writeTimeout(),
+		IdleTimeout:  config.IdleTimeout,
+	}
+
+	if server.ReadTimeout <= 0 {
+		server.ReadTimeout = 10 * time.Second
+	}
+	if server.IdleTimeout <= 0 {
+		server.IdleTimeout = time.Minute
+	}
+
+	return server
+}
+
+// writeTimeout limits writing a response, 10s unless configured
+func (c *Config) writeTimeout() time.Duration {
+	if c.WriteTimeout <= 0 {
+		return 10 * time.Second
+	}
+
+	return c.WriteTimeout
+}
+
+// defaultMaxBodyBytes limits request bodies unless max_body_bytes is set
+const defaultMaxBodyBytes = 1 << 20
+
+// maxBodyBytes returns the limit of request bodies, 0 if they aren't limited
+func (c *Config) maxBodyBytes() int64 {
+	switch {
+	case c.MaxBodyBytes < 0:
+		return 0
+	case c.MaxBodyBytes == 0:
+		return defaultMaxBodyBytes
+	}
+
+	return c.MaxBodyBytes
+}
+
+// withBodyLimit rejects requests declaring a body over max_body_bytes with 413
+// and cuts off reading bodies of unknown length at the limit
+func withBodyLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := currentConfig().maxBodyBytes()
+		if limit == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.ContentLength > limit {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// httpsRedirect permanently redirects requests to the same URL over HTTPS,
+// served on the port of address
+func httpsRedirect(address string) http.Handler {
+	_, port, _ := net.SplitHostPort(address)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		target := *r.URL
+		target.Scheme = "https"
+		target.Host = host
+		http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+	})
+}
+
+// listen listens on a TCP host:port address or, for addresses starting with
+// unix:, on a Unix domain socket replacing a stale one left behind
+func listen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, "unix:") {
+		return net.Listen("tcp", address)
+	}
+
+	path := strings.TrimPrefix(address, "unix:")
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		err = os.Remove(path)
+		if err != nil {
+			return nil, fmt.Errorf("removing stale socket: %v", err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Owner and group only, a reverse proxy has to be in the group to connect
+	err = os.Chmod(path, 0660)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// configSource is the path or URL the config is loaded from
+var configSource string
+
+// reloading makes reloads triggered at the same time happen one after another
+var reloading sync.Mutex
+
+// reload loads, validates and installs the config at path, the current config
+// stays in use if anything goes wrong
+// Listener settings, events and the GeoIP database are only set up at startup,
+// changing them requires a restart
+func reload(path string) error {
+	reloading.Lock()
+	defer reloading.Unlock()
+
+	config, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return err
+	}
+
+	old := currentConfig()
+	if config.GeoIPDB != old.GeoIPDB {
+		return fmt.Errorf("geoip_db can't be changed without a restart")
+	}
+
+	if !reflect.DeepEqual(startupSettings(&config), startupSettings(old)) {
+		slog.Warn("Changes of address, connection limits, timeouts, TLS and events only apply after a restart")
+	}
+
+	err = configureLogging(&config)
+	if err != nil {
+		return fmt.Errorf("opening log_file: %v", err)
+	}
+	logRoutes(config)
+	install(&config)
+	return nil
+}
+
+// toggleRoute enables or disables the route at path in the config in use,
+// until the next reload replaces it
+// Like on a reload, rate limits and round_robin turns of all routes start over
+func toggleRoute(path string, enabled bool) error {
+	reloading.Lock()
+	defer reloading.Unlock()
+
+	old := currentConfig()
+	route, ok := old.Routes[path]
+	if !ok {
+		return fmt.Errorf("unknown route %s", path)
+	}
+	route.Enabled = &enabled
+
+	config := *old
+	config.Routes = make(map[string]Route, len(old.Routes))
+	for p, r := range old.Routes {
+		config.Routes[p] = r
+	}
+	config.Routes[path] = route
+
+	install(&config)
+	return nil
+}
+
+// startupSettings returns the part of config which is only applied at startup
+func startupSettings(config *Config) Config {
+	return Config{
+		Address:             config.Address,
+		MaxConnsPerIP:       config.MaxConnsPerIP,
+		ConnLimitMode:       config.ConnLimitMode,
+		ConnQueueTimeout:    config.ConnQueueTimeout,
+		Events:              config.Events,
+		TLSCert:             config.TLSCert,
+		TLSKey:              config.TLSKey,
+		TLSMinVersion:       config.TLSMinVersion,
+		AutoTLS:             config.AutoTLS,
+		RedirectHTTPToHTTPS: config.RedirectHTTPToHTTPS,
+		ReadTimeout:         config.ReadTimeout,
+		WriteTimeout:        config.WriteTimeout,
+		IdleTimeout:         config.IdleTimeout,
+	}
+}
+
+// reloadOnSIGHUP reloads the config from path whenever SIGHUP is received,
+// reopening log_file first for logrotate
+func reloadOnSIGHUP(path string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			err := logOutput.reopen()
+			if err != nil {
+				slog.Error("Reopening log_file failed", "error", err)
+			}
+
+			slog.Info("Reloading config", "path", path)
+
+			err = reload(path)
+			if err != nil {
+				slog.Error("Config reload failed, keeping the current one", "error", err)
+				continue
+			}
+
+			slog.Info("Config reloaded")
+		}
+	}()
+}
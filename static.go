@@ -0,0 +1,84 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+)
+
+// StaticResponse is written instead of redirecting when conditions of a route pass,
+// with the inline Body or contents of File
+type StaticResponse struct {
+	Status      int    `yaml:"status,omitempty"`
+	Body        string `yaml:"body,omitempty"`
+	File        string `yaml:"file,omitempty"`
+	ContentType string `yaml:"content_type,omitempty"`
+
+	content []byte
+}
+
+// load checks the response and reads its file, so it's only read once per
+// (re)load of the config
+func (s *StaticResponse) load() error {
+	if s.Status == 0 {
+		s.Status = http.StatusOK
+	}
+	if s.Status < 200 || s.Status > 599 || (s.Status >= 300 && s.Status <= 399) {
+		return fmt.Errorf("status has to be 2xx, 4xx or 5xx, got %d", s.Status)
+	}
+
+	if s.Body != "" && s.File != "" {
+		return fmt.Errorf("only one of body and file can be set")
+	}
+
+	if s.File == "" {
+		s.content = []byte(s.Body)
+		if s.ContentType == "" {
+			s.ContentType = "text/plain; charset=utf-8"
+		}
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(s.File)
+	if err != nil {
+		return err
+	}
+
+	s.content = content
+	if s.ContentType == "" {
+		s.ContentType = mime.TypeByExtension(filepath.Ext(s.File))
+	}
+	return nil
+}
+
+func (s *StaticResponse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Left empty the type is sniffed from the content
+	if s.ContentType != "" {
+		w.Header().Set("Content-Type", s.ContentType)
+	}
+
+	w.WriteHeader(s.Status)
+	w.Write(s.content)
+}
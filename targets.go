@@ -0,0 +1,134 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Target is one of the success targets of a route, weights are integers, so
+// a target is picked with probability of exactly its weight divided by the sum
+// of all weights, without any rounding
+type Target struct {
+	URL    string `yaml:"url" json:"url"`
+	Weight int    `yaml:"weight" json:"weight,omitempty"`
+}
+
+// targetStrategies lists ways of picking one of the targets
+var targetStrategies = map[string]bool{
+	"weighted":    true,
+	"random":      true,
+	"round_robin": true,
+}
+
+// StickyConfig keeps repeat visitors on the target they were sent to first,
+// remembering its index in a cookie
+type StickyConfig struct {
+	Cookie string        `yaml:"cookie,omitempty"`
+	TTL    time.Duration `yaml:"ttl,omitempty"`
+}
+
+// successTarget picks the success target of a route, success_redirect is a
+// shorthand for a single target
+// Clients accepting one of the accept_redirects media types get its target
+// instead. With sticky targets the one remembered in the cookie is reused,
+// a missing, tampered or out of range cookie falls back to picking a new one
+// Headers of the response (Vary, Set-Cookie) are added to header
+func (r Route) successTarget(header http.Header, req *http.Request, turn *uint64) string {
+	if len(r.AcceptRedirects) > 0 {
+		header.Add("Vary", "Accept")
+		if negotiated, ok := negotiate(req.Header.Get("Accept"), r.AcceptRedirects); ok {
+			return negotiated
+		}
+	}
+
+	if len(r.Targets) == 0 {
+		return r.SuccessRedirect
+	}
+
+	if r.Sticky == nil {
+		return r.Targets[r.pickTarget(turn)].URL
+	}
+
+	name := r.Sticky.Cookie
+	if name == "" {
+		name = "toasted_target"
+	}
+
+	index := -1
+	if cookie, err := req.Cookie(name); err == nil {
+		if i, err := strconv.Atoi(cookie.Value); err == nil && i >= 0 && i < len(r.Targets) {
+			index = i
+		}
+	}
+	if index < 0 {
+		index = r.pickTarget(turn)
+	}
+
+	// Written every time, so the TTL counts from the last visit
+	cookie := &http.Cookie{Name: name, Value: strconv.Itoa(index), Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode}
+	if r.Sticky.TTL > 0 {
+		cookie.MaxAge = int(r.Sticky.TTL.Seconds())
+	}
+	header.Add("Set-Cookie", cookie.String())
+
+	return r.Targets[index].URL
+}
+
+// pickTarget returns index of one of the targets
+// Targets are picked at random by their weights, uniformly at random (random)
+// or in turns (round_robin), turn counts requests handled with round_robin
+func (r Route) pickTarget(turn *uint64) int {
+	if len(r.Targets) == 1 {
+		return 0
+	}
+
+	switch r.Strategy {
+	case "random":
+		return rand.Intn(len(r.Targets))
+	case "round_robin":
+		return int((atomic.AddUint64(turn, 1) - 1) % uint64(len(r.Targets)))
+	}
+
+	// First target whose cumulative weight is above a point drawn from
+	// [0, sum of all weights)
+	point := rand.Intn(r.cumulative[len(r.cumulative)-1])
+	return sort.Search(len(r.cumulative), func(i int) bool {
+		return r.cumulative[i] > point
+	})
+}
+
+// loadTargets sums up weights of the targets, so picking one only takes
+// a binary search
+func (r *Route) loadTargets() {
+	r.cumulative = make([]int, len(r.Targets))
+
+	total := 0
+	for i, target := range r.Targets {
+		total += target.Weight
+		r.cumulative[i] = total
+	}
+}
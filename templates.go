@@ -0,0 +1,180 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// TargetData is what templated targets can refer to, e.g.
+// https://example.com/{{.Host}}{{.URL.Path}}?ua={{.UserAgent}}
+type TargetData struct {
+	Host      string
+	URL       TargetURL
+	UserAgent string
+	Query     url.Values
+	Headers   http.Header
+	Params    map[string]string
+}
+
+// TargetURL is the part of the request URL available to templates
+type TargetURL struct {
+	Path     string
+	RawQuery string
+}
+
+// targetFuncs are available in templated targets, values printed by
+// templates are escaped unless piped to raw
+var targetFuncs = template.FuncMap{
+	"escape": escapeTargetValue,
+	"raw":    func(v interface{}) string { return fmt.Sprint(v) },
+}
+
+// escapeTargetValue percent-encodes everything but unreserved characters and
+// slashes, so values can't break out of the path segment or query value
+// they're put into, while paths stay paths
+func escapeTargetValue(v interface{}) string {
+	s := fmt.Sprint(v)
+
+	var escaped strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+
+	return escaped.String()
+}
+
+// escapeActions pipes values printed by the actions in list through escape,
+// like html/template does with its escapers
+func escapeActions(list *parse.ListNode) {
+	if list == nil {
+		return
+	}
+
+	for _, node := range list.Nodes {
+		switch node := node.(type) {
+		case *parse.ActionNode:
+			// Declarations like {{$x := .Host}} don't print anything
+			if len(node.Pipe.Decl) > 0 {
+				continue
+			}
+
+			last := node.Pipe.Cmds[len(node.Pipe.Cmds)-1]
+			if ident, ok := last.Args[0].(*parse.IdentifierNode); ok && ident.Ident == "raw" {
+				continue
+			}
+
+			node.Pipe.Cmds = append(node.Pipe.Cmds, &parse.CommandNode{
+				NodeType: parse.NodeCommand,
+				Pos:      node.Pos,
+				Args:     []parse.Node{parse.NewIdentifier("escape").SetPos(node.Pos)},
+			})
+		case *parse.IfNode:
+			escapeActions(node.List)
+			escapeActions(node.ElseList)
+		case *parse.RangeNode:
+			escapeActions(node.List)
+			escapeActions(node.ElseList)
+		case *parse.WithNode:
+			escapeActions(node.List)
+			escapeActions(node.ElseList)
+		}
+	}
+}
+
+// targets lists every target the route can redirect to
+func (r *Route) targets() []string {
+	targets := []string{r.SuccessRedirect, r.FailureRedirect}
+	for _, target := range r.Targets {
+		targets = append(targets, target.URL)
+	}
+	for _, target := range r.AcceptRedirects {
+		targets = append(targets, target)
+	}
+	for _, condition := range r.AllConditions() {
+		targets = append(targets, condition.ShortCircuitTarget, condition.FailureRedirect)
+	}
+
+	return targets
+}
+
+// parseTemplates compiles targets of the route containing {{ as templates
+func (r *Route) parseTemplates() error {
+	r.templates = map[string]*template.Template{}
+
+	for _, target := range r.targets() {
+		if !strings.Contains(target, "{{") || r.templates[target] != nil {
+			continue
+		}
+
+		tmpl, err := template.New("target").Funcs(targetFuncs).Option("missingkey=zero").Parse(target)
+		if err != nil {
+			return fmt.Errorf("target %q: %v", target, err)
+		}
+		escapeActions(tmpl.Tree.Root)
+
+		r.templates[target] = tmpl
+	}
+
+	return nil
+}
+
+// expand executes target if it's a template, other targets are returned as
+// they are
+func (r Route) expand(target string, req *http.Request, ps httprouter.Params) string {
+	tmpl, ok := r.templates[target]
+	if !ok {
+		return target
+	}
+
+	data := TargetData{
+		Host:      req.Host,
+		URL:       TargetURL{Path: req.URL.Path, RawQuery: req.URL.RawQuery},
+		UserAgent: req.Header.Get("User-Agent"),
+		Query:     req.URL.Query(),
+		Headers:   req.Header,
+		Params:    map[string]string{},
+	}
+	for _, p := range ps {
+		data.Params[p.Key] = p.Value
+	}
+
+	var expanded strings.Builder
+	err := tmpl.Execute(&expanded, data)
+	if err != nil {
+		slog.WarnContext(req.Context(), "Cannot expand target", "route", r.Path, "target", target, "error", err)
+	}
+
+	return expanded.String()
+}
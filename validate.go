@@ -0,0 +1,563 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Problem is a single finding of config validation, Route, File, Group and
+// Condition locate it when it's about a route, File is only known when the
+// config was loaded from files and Group is the dotted index of a nested group
+type Problem struct {
+	Route     string `json:"route,omitempty"`
+	File      string `json:"file,omitempty"`
+	Group     string `json:"group,omitempty"`
+	Condition string `json:"condition,omitempty"`
+	Severity  string `json:"severity"`
+	Message   string `json:"message"`
+}
+
+// problemf creates an error problem which isn't about a route
+func problemf(format string, args ...interface{}) Problem {
+	return Problem{Severity: "error", Message: fmt.Sprintf(format, args...)}
+}
+
+func (p Problem) String() string {
+	prefix := ""
+	if p.Route != "" {
+		prefix = fmt.Sprintf("route %q: ", p.Route)
+		if p.File != "" {
+			prefix = fmt.Sprintf("route %q in %s: ", p.Route, p.File)
+		}
+	}
+	if p.Group != "" {
+		prefix += "group " + p.Group + ": "
+	}
+	if p.Condition != "" {
+		prefix += fmt.Sprintf("condition %q: ", p.Condition)
+	}
+
+	return prefix + p.Message
+}
+
+// ValidationError lists every problem found in a config
+type ValidationError []Problem
+
+func (e ValidationError) Error() string {
+	lines := make([]string, len(e))
+	for i, problem := range e {
+		lines[i] = problem.String()
+	}
+
+	return "invalid config:\n  - " + strings.Join(lines, "\n  - ")
+}
+
+// CheckReport is the outcome of -check -format json
+type CheckReport struct {
+	Valid    bool      `json:"valid"`
+	Errors   int       `json:"errors"`
+	Warnings int       `json:"warnings"`
+	Problems []Problem `json:"problems"`
+}
+
+// checkReport describes the outcome of loading and validating a config, an
+// error loading it is reported as a single problem
+func checkReport(err error) CheckReport {
+	report := CheckReport{Problems: []Problem{}}
+
+	var problems ValidationError
+	if errors.As(err, &problems) {
+		report.Problems = problems
+	} else if err != nil {
+		report.Problems = append(report.Problems, problemf("%v", err))
+	}
+
+	for _, problem := range report.Problems {
+		switch problem.Severity {
+		case "error":
+			report.Errors++
+		case "warning":
+			report.Warnings++
+		}
+	}
+	report.Valid = report.Errors == 0
+
+	return report
+}
+
+// inRoute places problems in the route at path
+func (c *Config) inRoute(path string, problems ...Problem) []Problem {
+	for i := range problems {
+		problems[i].Route, problems[i].File = path, c.sources[path]
+	}
+
+	return problems
+}
+
+// defaultRedirectStatus returns status of routes without redirect_status,
+// 302 unless configured
+func (c *Config) defaultRedirectStatus() int {
+	if c.DefaultRedirectStatus == 0 {
+		return http.StatusFound
+	}
+
+	return c.DefaultRedirectStatus
+}
+
+// headerProblems lists header names and values which can't be sent
+func headerProblems(headers map[string]string) []string {
+	problems := []string{}
+	for name, value := range headers {
+		if name == "" || strings.ContainsAny(name, " \t:\r\n") {
+			problems = append(problems, fmt.Sprintf("invalid header name %q", name))
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			problems = append(problems, fmt.Sprintf("header %s: value can't contain line breaks", name))
+		}
+	}
+	sort.Strings(problems)
+
+	return problems
+}
+
+// Validate checks the whole config and parses conditions of all routes
+// Routes without redirect_status get the default one
+// Instead of stopping at the first problem it collects all of them into
+// a ValidationError
+func (c *Config) Validate() error {
+	problems := ValidationError{}
+
+	for _, source := range c.CohortKey {
+		if !cohortKeySources[source] {
+			problems = append(problems, problemf("unknown cohort key source %q", source))
+		}
+	}
+
+	if c.Buckets.Assignment != "" && c.Buckets.Assignment != "random" && c.Buckets.Assignment != "hash" {
+		problems = append(problems, problemf("unknown bucket assignment %q", c.Buckets.Assignment))
+	}
+
+	for name, weight := range c.Buckets.Weights {
+		if weight <= 0 {
+			problems = append(problems, problemf("bucket %q: weight has to be positive", name))
+		}
+	}
+
+	err := c.Bots.load()
+	if err != nil {
+		problems = append(problems, problemf("bots: %v", err))
+	}
+
+	if c.IPFilter != nil {
+		err := c.IPFilter.load(c.defaultRedirectStatus())
+		if err != nil {
+			problems = append(problems, problemf("ip_filter: %v", err))
+		}
+	}
+
+	err = c.Admin.load()
+	if err != nil {
+		problems = append(problems, problemf("admin: %v", err))
+	}
+
+	if c.Metrics.Protected && !c.Admin.enabled() {
+		problems = append(problems, problemf("metrics: protected requires admin token or basic_auth"))
+	}
+
+	if c.BasicAuth != nil {
+		err := c.BasicAuth.load()
+		if err != nil {
+			problems = append(problems, problemf("basic_auth: %v", err))
+		}
+	}
+
+	if c.Timezone != "" {
+		location, err := time.LoadLocation(c.Timezone)
+		if err != nil {
+			problems = append(problems, problemf("unknown timezone %q", c.Timezone))
+		}
+		c.location = location
+	}
+
+	if _, ok := logLevels[c.LogLevel]; c.LogLevel != "" && !ok {
+		problems = append(problems, problemf("unknown log level %q", c.LogLevel))
+	}
+
+	if c.LogFormat != "" && c.LogFormat != "text" && c.LogFormat != "json" {
+		problems = append(problems, problemf("unknown log format %q", c.LogFormat))
+	}
+
+	if c.AccessLog != "" && c.AccessLog != "combined" && c.AccessLog != "json" {
+		problems = append(problems, problemf("unknown access log format %q", c.AccessLog))
+	}
+
+	if c.DefaultRedirectStatus != 0 && (c.DefaultRedirectStatus < 300 || c.DefaultRedirectStatus > 399) {
+		problems = append(problems, problemf("default_redirect_status has to be 3xx, got %d", c.DefaultRedirectStatus))
+	}
+
+	if status := c.NotFoundRedirectStatus; status != 0 && (status < 300 || status > 399) {
+		problems = append(problems, problemf("not_found_redirect_status has to be 3xx, got %d", status))
+	}
+
+	if c.NotFoundRedirectStatus != 0 && c.NotFoundRedirect == "" {
+		problems = append(problems, problemf("not_found_redirect_status is only used with not_found_redirect"))
+	}
+
+	c.notFound = nil
+	if c.NotFoundStatus != 0 || c.NotFoundBody != "" || c.NotFoundFile != "" || c.NotFoundContentType != "" {
+		c.notFound = &StaticResponse{Status: c.NotFoundStatus, Body: c.NotFoundBody, File: c.NotFoundFile, ContentType: c.NotFoundContentType}
+		if c.notFound.Status == 0 {
+			c.notFound.Status = http.StatusNotFound
+		}
+
+		if c.NotFoundRedirect != "" {
+			problems = append(problems, problemf("not_found_redirect can't be combined with not_found_status, _body, _file and _content_type"))
+		} else if err := c.notFound.load(); err != nil {
+			problems = append(problems, problemf("not_found: %v", err))
+		}
+	}
+
+	if status := c.MethodNotAllowedRedirectStatus; status != 0 && (status < 300 || status > 399) {
+		problems = append(problems, problemf("method_not_allowed_redirect_status has to be 3xx, got %d", status))
+	}
+
+	if c.MethodNotAllowedRedirectStatus != 0 && c.MethodNotAllowedRedirect == "" {
+		problems = append(problems, problemf("method_not_allowed_redirect_status is only used with method_not_allowed_redirect"))
+	}
+
+	if c.ConnLimitMode != "" && c.ConnLimitMode != "reject" && c.ConnLimitMode != "queue" {
+		problems = append(problems, problemf("unknown connection limit mode %q", c.ConnLimitMode))
+	}
+
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		problems = append(problems, problemf("tls_cert and tls_key have to be set together"))
+	}
+
+	if c.AutoTLS.Enabled() && c.TLSCert != "" {
+		problems = append(problems, problemf("autotls can't be used together with tls_cert and tls_key"))
+	}
+
+	if c.AutoTLS.Enabled() && c.AutoTLS.CacheDir == "" {
+		problems = append(problems, problemf("autotls: cache_dir is empty"))
+	}
+
+	if c.RedirectHTTPToHTTPS && c.TLSCert == "" && !c.AutoTLS.Enabled() {
+		problems = append(problems, problemf("redirect_http_to_https requires tls_cert and tls_key or autotls"))
+	}
+
+	if c.TLSMinVersion != "" {
+		if _, ok := tlsVersions[normalizeTLSVersion(c.TLSMinVersion)]; !ok {
+			problems = append(problems, problemf("unknown TLS version %q", c.TLSMinVersion))
+		}
+	}
+
+	for _, problem := range headerProblems(c.Headers) {
+		problems = append(problems, problemf("headers: %s", problem))
+	}
+
+	if c.CORS != nil {
+		err := c.CORS.check()
+		if err != nil {
+			problems = append(problems, problemf("cors: %v", err))
+		}
+	}
+
+	// Sorted so the report doesn't change between runs
+	paths := make([]string, 0, len(c.Routes))
+	for path := range c.Routes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		route := c.Routes[path]
+		invalid := func(format string, args ...interface{}) {
+			problems = append(problems, c.inRoute(path, problemf(format, args...))...)
+		}
+
+		if path == c.healthPath() {
+			invalid("path is used by the health check, change health_path to use it")
+		}
+
+		if !c.Metrics.Disabled && path == c.Metrics.path() {
+			invalid("path is used by metrics, change metrics.path to use it")
+		}
+
+		if c.Admin.enabled() && path == c.Admin.reloadPath() {
+			invalid("path is used by the admin reload endpoint, change admin.reload_path to use it")
+		}
+
+		if c.Admin.enabled() && path == c.Admin.explainPath() {
+			invalid("path is used by the admin explain endpoint, change admin.explain_path to use it")
+		}
+
+		if route.RedirectStatus == 0 {
+			route.RedirectStatus = c.defaultRedirectStatus()
+			c.Routes[path] = route
+		}
+
+		if route.RedirectStatus < 300 || route.RedirectStatus > 399 {
+			invalid("redirect_status has to be 3xx, got %d", route.RedirectStatus)
+		}
+
+		if route.StripPrefix != "" && !route.AppendPath {
+			invalid("strip_prefix is only used with append_path")
+		}
+
+		if route.Respond != nil && route.ProxyTo != "" {
+			invalid("only one of respond and proxy_to can be set")
+		}
+
+		if route.ProxyTo != "" {
+			backend, err := url.Parse(route.ProxyTo)
+			if err != nil || backend.Scheme == "" || backend.Host == "" {
+				invalid("proxy_to has to be an absolute URL, got %q", route.ProxyTo)
+			}
+		} else if route.Respond != nil {
+			err := route.Respond.load()
+			if err != nil {
+				invalid("respond: %v", err)
+			}
+		} else if len(route.Targets) > 0 {
+			if route.SuccessRedirect != "" {
+				invalid("only one of success_redirect and targets can be set")
+			}
+
+			for i, target := range route.Targets {
+				if target.URL == "" {
+					invalid("target %d: url is empty", i)
+				}
+				if target.Weight <= 0 && (route.Strategy == "" || route.Strategy == "weighted") {
+					invalid("target %d: weight has to be positive", i)
+				}
+			}
+			route.loadTargets()
+		} else if route.SuccessRedirect == "" {
+			invalid("success_redirect is empty")
+		}
+
+		for _, problem := range headerProblems(route.Headers) {
+			invalid("headers: %s", problem)
+		}
+
+		for i, cookie := range route.SetCookies {
+			if !validCookieName(cookie.Name) {
+				invalid("set_cookies %d: invalid cookie name %q", i, cookie.Name)
+			}
+		}
+
+		if route.BasicAuth != nil {
+			err := route.BasicAuth.load()
+			if err != nil {
+				invalid("basic_auth: %v", err)
+			}
+		}
+
+		if route.RateLimit != nil {
+			err := route.RateLimit.load()
+			if err != nil {
+				invalid("rate_limit: %v", err)
+			}
+		}
+
+		if route.Sticky != nil && len(route.Targets) == 0 {
+			invalid("sticky is only used with targets")
+		}
+
+		if route.Strategy != "" && !targetStrategies[route.Strategy] {
+			invalid("unknown target strategy %q", route.Strategy)
+		}
+
+		if len(route.AllowedMethods) == 0 {
+			invalid("no allowed_methods")
+		}
+
+		seen := map[string]bool{}
+		for _, method := range route.AllowedMethods {
+			if seen[method] {
+				invalid("allowed_methods lists %s more than once", method)
+			}
+			seen[method] = true
+		}
+
+		if route.CORS != nil {
+			err := route.CORS.check()
+			if err != nil {
+				invalid("cors: %v", err)
+			}
+		}
+
+		if route.CORS != nil || c.CORS != nil {
+			for _, method := range route.AllowedMethods {
+				if method == "OPTIONS" {
+					invalid("OPTIONS requests are answered by cors, it can't be in allowed_methods")
+				}
+			}
+		}
+
+		conditionProblems := route.ParseConditions()
+		if len(conditionProblems) > 0 {
+			problems = append(problems, c.inRoute(path, conditionProblems...)...)
+			continue
+		}
+		c.Routes[path] = route
+
+		for _, condition := range route.AllConditions() {
+			if condition.Type == "Geo" && c.GeoIPDB == "" {
+				problem := problemf("Geo conditions require geoip_db")
+				problem.Condition = condition.Raw
+				problems = append(problems, c.inRoute(path, problem)...)
+			}
+		}
+	}
+
+	problems = append(problems, c.routeConflicts(paths)...)
+
+	if len(problems) > 0 {
+		return problems
+	}
+
+	return nil
+}
+
+// registration is a path registered for a method by a route or one of the
+// built-in endpoints
+type registration struct {
+	method, path, owner string
+}
+
+// register adds a registration to router, returning what httprouter panics
+// with if the path conflicts with the ones already registered
+func register(router *httprouter.Router, r registration) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("%v", recovered)
+		}
+	}()
+
+	router.Handle(r.method, r.path, func(http.ResponseWriter, *http.Request, httprouter.Params) {})
+	return nil
+}
+
+// routeConflicts registers paths of the built-in endpoints and the enabled
+// routes like buildRouter does, reporting routes httprouter would refuse
+// along with what they conflict with, e.g. /user/:id and /user/:name
+func (c *Config) routeConflicts(paths []string) []Problem {
+	registered := []registration{
+		{"GET", c.healthPath(), "the health check"},
+		{"HEAD", c.healthPath(), "the health check"},
+	}
+	if !c.Metrics.Disabled {
+		registered = append(registered, registration{"GET", c.Metrics.path(), "metrics"})
+	}
+	if c.Admin.enabled() {
+		registered = append(registered,
+			registration{"POST", c.Admin.reloadPath(), "the admin reload endpoint"},
+			registration{"GET", c.Admin.explainPath(), "the admin explain endpoint"},
+			registration{"POST", c.Admin.routesPath() + "/*route", "the admin routes endpoint"})
+	}
+	if c.Events.Webhook != "" {
+		registered = append(registered, registration{"GET", "/debug/vars", "/debug/vars"})
+	}
+	if c.ExampleRoutes {
+		for _, path := range []string{"/bye", "/panel"} {
+			if _, ok := c.Routes[path]; !ok {
+				registered = append(registered, registration{"GET", path, "example route " + path})
+			}
+		}
+	}
+
+	router := httprouter.New()
+	for _, r := range registered {
+		// Built-in paths are checked separately, there's nothing to report here
+		register(router, r)
+	}
+
+	// Routes on these are already reported by Validate
+	reserved := map[string]bool{c.healthPath(): true}
+	if !c.Metrics.Disabled {
+		reserved[c.Metrics.path()] = true
+	}
+	if c.Admin.enabled() {
+		reserved[c.Admin.reloadPath()] = true
+		reserved[c.Admin.explainPath()] = true
+	}
+
+	problems := []Problem{}
+	for _, path := range paths {
+		route := c.Routes[path]
+		if _, ok := rootCatchAll(path); ok || !route.enabled() || reserved[path] {
+			continue
+		}
+
+		methods := append([]string{}, c.methods(route)...)
+		if route.CORS != nil || c.CORS != nil || c.autoOPTIONS() {
+			methods = append(methods, "OPTIONS")
+		}
+
+		done := map[string]bool{}
+		for _, method := range methods {
+			// Repeated methods are reported along with the rest of allowed_methods
+			if done[method] {
+				continue
+			}
+			done[method] = true
+
+			r := registration{method, path, "route " + path}
+			err := register(router, r)
+			if err == nil {
+				registered = append(registered, r)
+				continue
+			}
+
+			problems = append(problems, c.inRoute(path, problemf("%s", conflictOf(registered, r, err)))...)
+			break
+		}
+	}
+
+	return problems
+}
+
+// conflictOf names the registration r conflicts with, falling back to the
+// error of httprouter if no single one does
+func conflictOf(registered []registration, r registration, err error) string {
+	if register(httprouter.New(), r) != nil {
+		return err.Error()
+	}
+
+	for _, other := range registered {
+		router := httprouter.New()
+		if register(router, other) == nil && register(router, r) != nil {
+			return fmt.Sprintf("conflicts with %s on %s %s", other.owner, r.method, other.path)
+		}
+	}
+
+	return err.Error()
+}
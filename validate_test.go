@@ -0,0 +1,205 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateMatchModes(t *testing.T) {
+	tests := []struct {
+		name    string
+		group   Group
+		problem string
+	}{
+		{
+			name:  "all without conditions",
+			group: Group{},
+		},
+		{
+			name:    "any without conditions",
+			group:   Group{Match: "any"},
+			problem: "match: any needs",
+		},
+		{
+			name: "any with only labelled and short-circuit conditions",
+			group: Group{Match: "any", Conditions: []*Condition{
+				{Raw: "Path is /a as a"},
+				{Raw: "Path is /b", ShortCircuitTarget: "/b"},
+			}},
+			problem: "match: any needs",
+		},
+		{
+			name:  "any with a deciding condition",
+			group: Group{Match: "any", Conditions: []*Condition{{Raw: "Path is /a"}}},
+		},
+		{
+			name:  "any with a group",
+			group: Group{Match: "any", Groups: []*Group{{}}},
+		},
+		{
+			name:    "nested any without conditions",
+			group:   Group{Groups: []*Group{{Match: "any"}}},
+			problem: "group 0: match: any needs",
+		},
+		{
+			name:    "unknown match mode",
+			group:   Group{Match: "some"},
+			problem: `unknown match mode "some"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := Config{Routes: map[string]Route{
+				"/go": {
+					Match:           test.group.Match,
+					Conditions:      test.group.Conditions,
+					Groups:          test.group.Groups,
+					AllowedMethods:  []string{"GET"},
+					SuccessRedirect: "/success",
+					FailureRedirect: "/failure",
+				},
+			}}
+
+			err := config.Validate()
+			if test.problem == "" {
+				if err != nil {
+					t.Fatalf("expected a valid config, got %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), `route "/go": `+test.problem) {
+				t.Fatalf("expected problem %q, got %v", test.problem, err)
+			}
+		})
+	}
+}
+
+func TestEmptyAllGroupPasses(t *testing.T) {
+	req := httptest.NewRequest("GET", "/go", nil)
+
+	passed, _, _ := (&Group{}).Evaluate(req)
+	if !passed {
+		t.Fatal("expected a group without conditions to pass")
+	}
+
+	passed, _, _ = (&Group{Match: "all", Groups: []*Group{{}}}).Evaluate(req)
+	if !passed {
+		t.Fatal("expected a group with only empty groups to pass")
+	}
+}
+
+func TestValidateLabelScope(t *testing.T) {
+	tests := []struct {
+		name    string
+		group   Group
+		problem string
+	}{
+		{
+			name: "label of an enclosing group",
+			group: Group{
+				Conditions: []*Condition{{Raw: "Header:B is 1 as b"}},
+				Groups:     []*Group{{Conditions: []*Condition{{Raw: "Labels match !b"}}}},
+			},
+		},
+		{
+			// Header:A decides the first group before b is evaluated, so !b
+			// would see b as false
+			name: "label of a sibling group",
+			group: Group{
+				Match: "any",
+				Groups: []*Group{
+					{Conditions: []*Condition{{Raw: "Header:A is 1"}, {Raw: "Header:B is 1 as b"}}},
+					{Conditions: []*Condition{{Raw: "Labels match !b"}}},
+				},
+			},
+			problem: `group 1: condition "Labels match !b": unknown label "b"`,
+		},
+		{
+			name: "label defined twice",
+			group: Group{
+				Groups: []*Group{
+					{Conditions: []*Condition{{Raw: "Header:A is 1 as a"}}},
+					{Conditions: []*Condition{{Raw: "Header:B is 1 as a"}}},
+				},
+			},
+			problem: `group 1: condition "Header:B is 1 as a": label "a" is already defined`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			route := Route{Match: test.group.Match, Conditions: test.group.Conditions, Groups: test.group.Groups}
+
+			problems := route.ParseConditions()
+			if test.problem == "" {
+				if len(problems) > 0 {
+					t.Fatalf("expected no problems, got %v", problems)
+				}
+				return
+			}
+
+			if len(problems) != 1 || problems[0].String() != test.problem {
+				t.Fatalf("expected problem %q, got %v", test.problem, problems)
+			}
+		})
+	}
+}
+
+func TestValidateReservedPathsReportedOnce(t *testing.T) {
+	tests := []struct {
+		path    string
+		problem string
+	}{
+		{path: "/healthz", problem: "path is used by the health check"},
+		{path: "/metrics", problem: "path is used by metrics"},
+		{path: "/admin/reload", problem: "path is used by the admin reload endpoint"},
+		{path: "/admin/explain", problem: "path is used by the admin explain endpoint"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			config := Config{
+				Admin: AdminConfig{Token: "secret"},
+				Routes: map[string]Route{
+					test.path: {
+						AllowedMethods:  []string{"GET", "POST"},
+						SuccessRedirect: "/success",
+						FailureRedirect: "/failure",
+					},
+				},
+			}
+
+			err := config.Validate()
+			problems, ok := err.(ValidationError)
+			if !ok {
+				t.Fatalf("expected a ValidationError, got %v", err)
+			}
+			if len(problems) != 1 || !strings.Contains(problems[0].Message, test.problem) {
+				t.Fatalf("expected only problem %q, got %v", test.problem, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2018 Miłosz Skaza
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// velocityTracker counts requests per key (e.g. User-Agent) with a sliding
+// window counter, the number of tracked keys is bounded and the least recently
+// seen ones are evicted first
+type velocityTracker struct {
+	window  time.Duration
+	maxKeys int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type velocityEntry struct {
+	key         string
+	windowStart time.Time
+	current     int
+	previous    int
+}
+
+func newVelocityTracker(window time.Duration, maxKeys int) *velocityTracker {
+	return &velocityTracker{
+		window:  window,
+		maxKeys: maxKeys,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// Hit records a request for key and returns the number of requests seen within
+// the last window, approximated from the current and previous fixed windows
+func (t *velocityTracker) Hit(key string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+
+	element, ok := t.entries[key]
+	if ok {
+		t.lru.MoveToFront(element)
+	} else {
+		element = t.lru.PushFront(&velocityEntry{key: key, windowStart: now.Truncate(t.window)})
+		t.entries[key] = element
+
+		if t.lru.Len() > t.maxKeys {
+			oldest := t.lru.Back()
+			t.lru.Remove(oldest)
+			delete(t.entries, oldest.Value.(*velocityEntry).key)
+		}
+	}
+
+	entry := element.Value.(*velocityEntry)
+	elapsed := now.Sub(entry.windowStart)
+	switch {
+	case elapsed >= 2*t.window:
+		entry.previous, entry.current = 0, 0
+		entry.windowStart = now.Truncate(t.window)
+	case elapsed >= t.window:
+		entry.previous, entry.current = entry.current, 0
+		entry.windowStart = entry.windowStart.Add(t.window)
+	}
+	entry.current++
+
+	// Previous window counts proportionally to how much of it is still covered
+	weight := 1 - float64(now.Sub(entry.windowStart))/float64(t.window)
+	return int(float64(entry.previous)*weight) + entry.current
+}